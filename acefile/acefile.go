@@ -0,0 +1,172 @@
+// Package acefile reads and writes ace env files.
+//
+// An env file is a sequence of blocks. Each block starts with a header line
+// holding a random block key encrypted to the recipients of the block using
+// age, followed by one KEY=VALUE line per variable where the value is
+// encrypted with the block key, and ends with a blank line. Blocks are only
+// ever appended and later values override earlier ones.
+//
+// The format version of each block is part of its header line. Version 1
+// encodes the header and values using padded base32, version 2 uses unpadded
+// base64. A file may mix blocks of both versions.
+package acefile
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Format is the version of the format of a block.
+type Format int
+
+const (
+	V1 Format = 1
+	V2 Format = 2
+)
+
+const (
+	// PrefixV1 starts the header line of each version 1 block.
+	PrefixV1 = "# ace/v1:"
+	// PrefixV2 starts the header line of each version 2 block.
+	PrefixV2 = "# ace/v2:"
+)
+
+// headerPrefix is common to the header lines of all versions.
+const headerPrefix = "# ace/v"
+
+type encoding interface {
+	EncodeToString(src []byte) string
+	DecodeString(s string) ([]byte, error)
+}
+
+func (f Format) prefix() string {
+	if f == V1 {
+		return PrefixV1
+	}
+	return PrefixV2
+}
+
+func (f Format) encoding() encoding {
+	if f == V1 {
+		return base32.StdEncoding
+	}
+	return base64.RawStdEncoding
+}
+
+// ErrUnsupportedFormat is returned for blocks of a format version which is
+// newer than this package.
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// isHeader reports whether line is the header line of a block of any
+// version, `# ace/vN:`. Other comments, even if they start with `# ace/v`,
+// are not.
+func isHeader(line string) bool {
+	rest, ok := strings.CutPrefix(line, headerPrefix)
+	if !ok {
+		return false
+	}
+	version, _, ok := strings.Cut(rest, ":")
+	if !ok || version == "" {
+		return false
+	}
+	for _, c := range version {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeader returns the format and the encoded age header of a header
+// line.
+func parseHeader(line string) (Format, string, error) {
+	if header, ok := strings.CutPrefix(line, PrefixV1); ok {
+		return V1, header, nil
+	}
+	if header, ok := strings.CutPrefix(line, PrefixV2); ok {
+		return V2, header, nil
+	}
+	version, _, _ := strings.Cut(strings.TrimPrefix(line, headerPrefix), ":")
+	return 0, "", fmt.Errorf("%w version v%s, the block was written by a newer version of ace", ErrUnsupportedFormat, version)
+}
+
+// HighestFormat returns the highest format version of the blocks in r, or V1
+// if there are none. Blocks of unsupported versions are ignored.
+func HighestFormat(r io.Reader) (Format, error) {
+	highest := V1
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSpace(line); isHeader(line) {
+			if format, _, err := parseHeader(line); err == nil && format > highest {
+				highest = format
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return highest, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// BinarySuffix marks the key of an entry holding binary data, such as
+// `KEY:binary=...`. Binary values are stored verbatim without any quoting.
+const BinarySuffix = ":binary"
+
+// Entry is a decrypted variable.
+type Entry struct {
+	Key string
+	// Value as it was set, including any quotes. Use UnescapeValue to get
+	// the plain value. Binary values hold the raw bytes.
+	Value string
+	// Binary is set for values which were stored as raw bytes.
+	Binary bool
+	// Block is the 1-based index of the block the entry was read from.
+	Block int
+	// Line is the 1-based line number the entry was read from.
+	Line int
+}
+
+func (e Entry) String() string {
+	return e.Key + "=" + e.Value
+}
+
+// Unescaped returns the plain value of the entry. Binary values are returned
+// as is.
+func (e Entry) Unescaped() (string, error) {
+	if e.Binary {
+		return e.Value, nil
+	}
+	return UnescapeValue(e.Value)
+}
+
+func encryptValue(aead cipher.AEAD, enc encoding, value []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return enc.EncodeToString(aead.Seal(nonce, nonce, value, nil)), nil
+}
+
+func decryptValue(aead cipher.AEAD, enc encoding, value string) ([]byte, error) {
+	secret, err := enc.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secret) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := secret[:aead.NonceSize()], secret[aead.NonceSize():]
+
+	// Decrypt the message and check it wasn't tampered with.
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
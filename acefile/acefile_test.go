@@ -0,0 +1,876 @@
+package acefile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"filippo.io/age"
+)
+
+func newIdentity(t testing.TB) *age.X25519Identity {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func writeBlock(t testing.TB, w io.Writer, pairs []string, recipients ...age.Recipient) {
+	t.Helper()
+	aw := NewWriter(w, recipients...)
+	for _, p := range pairs {
+		k, v, _ := strings.Cut(p, "=")
+		if err := aw.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+
+	buf := &bytes.Buffer{}
+	writeBlock(t, buf, []string{"A=1", "B='two words'", "C=3"}, alice.Recipient(), bob.Recipient())
+	writeBlock(t, buf, []string{"A=alice"}, alice.Recipient())
+	writeBlock(t, buf, []string{"B=bob", "D=4"}, bob.Recipient())
+
+	tests := []struct {
+		name       string
+		identities []age.Identity
+		expected   []Entry
+	}{
+		{
+			name:       "alice",
+			identities: []age.Identity{alice},
+			expected: []Entry{
+				{Key: "A", Value: "alice", Block: 2, Line: 7},
+				{Key: "B", Value: "'two words'", Block: 1, Line: 3},
+				{Key: "C", Value: "3", Block: 1, Line: 4},
+			},
+		},
+		{
+			name:       "bob",
+			identities: []age.Identity{bob},
+			expected: []Entry{
+				{Key: "A", Value: "1", Block: 1, Line: 2},
+				{Key: "B", Value: "bob", Block: 3, Line: 10},
+				{Key: "C", Value: "3", Block: 1, Line: 4},
+				{Key: "D", Value: "4", Block: 3, Line: 11},
+			},
+		},
+		{
+			name:       "alice and bob",
+			identities: []age.Identity{bob, alice},
+			expected: []Entry{
+				{Key: "A", Value: "alice", Block: 2, Line: 7},
+				{Key: "B", Value: "bob", Block: 3, Line: 10},
+				{Key: "C", Value: "3", Block: 1, Line: 4},
+				{Key: "D", Value: "4", Block: 3, Line: 11},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := NewReader(bytes.NewReader(buf.Bytes()), tt.identities...).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, entries)
+			}
+		})
+	}
+
+	t.Run("next", func(t *testing.T) {
+		r := NewReader(bytes.NewReader(buf.Bytes()), alice)
+		var keys []string
+		for {
+			e, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, e.Key)
+		}
+		if strings.Join(keys, ",") != "A,B,C,A" {
+			t.Errorf("unexpected keys %v", keys)
+		}
+	})
+
+	t.Run("no identities", func(t *testing.T) {
+		_, err := NewReader(bytes.NewReader(buf.Bytes())).ReadAll()
+		if err == nil {
+			t.Fatal("expected an error without identities")
+		}
+	})
+}
+
+func TestWriter(t *testing.T) {
+	alice := newIdentity(t)
+
+	t.Run("invalid values are not written", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf, alice.Recipient())
+		if err := w.Set("A", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Set("B", `"unclosed`); err == nil {
+			t.Fatal("expected unclosed quote error")
+		}
+		if err := w.Set("#C", "1"); err == nil {
+			t.Fatal("expected invalid key error")
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("expected nothing to be written before flush, got %q", buf.String())
+		}
+	})
+
+	t.Run("single write per block", func(t *testing.T) {
+		cw := &countingWriter{}
+		w := NewWriter(cw, alice.Recipient())
+		for _, k := range []string{"A", "B", "C"} {
+			if err := w.Set(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if cw.writes != 1 {
+			t.Errorf("expected a single write, got %d", cw.writes)
+		}
+	})
+}
+
+func TestBinary(t *testing.T) {
+	alice := newIdentity(t)
+	data := []byte("\x00'quoted\n\xff")
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf, alice.Recipient())
+	if err := w.SetBinary("BLOB", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Set("TEXT", "'quoted'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetBinary("BAD"+BinarySuffix, data); err == nil {
+		t.Fatal("expected invalid key error")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\nBLOB:binary=") {
+		t.Fatalf("expected binary entry, got %q", buf.String())
+	}
+
+	entries, err := NewReader(buf, alice).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Entry{
+		{Key: "BLOB", Value: string(data), Binary: true, Block: 1, Line: 2},
+		{Key: "TEXT", Value: "'quoted'", Block: 1, Line: 3},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, entries)
+	}
+	for i, v := range []string{string(data), "quoted"} {
+		got, err := entries[i].Unescaped()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v {
+			t.Errorf("expected %q, got %q", v, got)
+		}
+	}
+}
+
+func TestLargeValues(t *testing.T) {
+	alice := newIdentity(t)
+
+	// a bundle of certificates well above the 64 KiB line limit of
+	// bufio.Scanner once encrypted and base32 encoded
+	var bundle strings.Builder
+	for bundle.Len() < 512*1024 {
+		bundle.WriteString("-----BEGIN CERTIFICATE-----\n")
+		bundle.WriteString(strings.Repeat("MIIBkTCB+wIJAKHHIG11kO5rMA0GCSqGSIb3DQEBCwUAMBQxEjAQBgNVBAMMCWxv\n", 20))
+		bundle.WriteString("-----END CERTIFICATE-----\n")
+	}
+	value := QuoteValue(bundle.String())
+
+	buf := &bytes.Buffer{}
+	writeBlock(t, buf, []string{"SMALL=1"}, alice.Recipient())
+	w := NewWriter(buf, alice.Recipient())
+	if err := w.Set("CA_BUNDLE", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetBinary("CA_BUNDLE_DER", []byte(bundle.String())); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writeBlock(t, buf, []string{"AFTER=2"}, alice.Recipient())
+
+	entries, err := NewReader(buf, alice).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	got, err := entries[1].Unescaped()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != bundle.String() {
+		t.Errorf("CA_BUNDLE does not match, got %d bytes, want %d", len(got), bundle.Len())
+	}
+	if entries[2].Value != bundle.String() {
+		t.Errorf("CA_BUNDLE_DER does not match, got %d bytes, want %d", len(entries[2].Value), bundle.Len())
+	}
+	if entries[3].String() != "AFTER=2" {
+		t.Errorf("expected AFTER=2, got %s", entries[3])
+	}
+}
+
+func TestFormats(t *testing.T) {
+	alice := newIdentity(t)
+
+	buf := &bytes.Buffer{}
+	for i, format := range []Format{V1, V2, V1} {
+		w := NewWriter(buf, alice.Recipient())
+		w.Format = format
+		if err := w.Set("A", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Set(fmt.Sprintf("V%d", format), "set"); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	for i, prefix := range map[int]string{0: PrefixV1, 4: PrefixV2, 8: PrefixV1} {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("expected line %d to start with %q, got %q", i+1, prefix, lines[i])
+		}
+	}
+
+	entries, err := NewReader(bytes.NewReader(buf.Bytes()), alice).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.String())
+	}
+	if strings.Join(got, " ") != "A=2 V1=set V2=set" {
+		t.Errorf("unexpected entries %v", got)
+	}
+
+	_, err = NewReader(strings.NewReader("# ace/v9:AAAA\nA=AAAA\n\n"), alice).ReadAll()
+	if !errors.Is(err, ErrUnsupportedFormat) || err.Error() != "unsupported format version v9, the block was written by a newer version of ace" {
+		t.Errorf("expected unsupported format error, got %v", err)
+	}
+
+	for data, expected := range map[string]Format{"": V1, buf.String(): V2, lines[0] + "\n# ace/v9:AAAA\n": V1} {
+		format, err := HighestFormat(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != expected {
+			t.Errorf("expected highest format v%d, got v%d", expected, format)
+		}
+	}
+}
+
+// BenchmarkFormat compares the size and parse time of the same variables
+// stored in each format version.
+func BenchmarkFormat(b *testing.B) {
+	alice := newIdentity(b)
+	for _, format := range []Format{V1, V2} {
+		b.Run(fmt.Sprintf("v%d", format), func(b *testing.B) {
+			buf := &bytes.Buffer{}
+			for i := 0; i < 100; i++ {
+				w := NewWriter(buf, alice.Recipient())
+				w.Format = format
+				for j := 0; j < 10; j++ {
+					if err := w.Set(fmt.Sprintf("KEY_%d", j), strings.Repeat("v", 64)); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := w.Flush(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			data := buf.Bytes()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := NewReader(bytes.NewReader(data), alice).ReadAll()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "file-bytes")
+		})
+	}
+}
+
+func TestReadAllAfterNext(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+	buf := &bytes.Buffer{}
+	writeBlock(t, buf, []string{"A=1", "B=2", "C=3"}, alice.Recipient())
+	writeBlock(t, buf, []string{"X=bob"}, bob.Recipient())
+	writeBlock(t, buf, []string{"A=4", "D=5"}, alice.Recipient())
+
+	r := NewReader(bytes.NewReader(buf.Bytes()), alice)
+	e, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.String() != "A=1" {
+		t.Fatalf("unexpected first entry %v", e)
+	}
+	entries, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, fmt.Sprintf("%s@%d:%d", e, e.Block, e.Line))
+	}
+	if strings.Join(got, " ") != "B=2@1:3 C=3@1:4 A=4@3:10 D=5@3:11" {
+		t.Errorf("expected ReadAll to continue the block, got %v", got)
+	}
+	if len(r.Skipped) != 1 || r.Skipped[0].Block != 2 {
+		t.Errorf("unexpected skipped blocks %+v", r.Skipped)
+	}
+}
+
+func TestReadAllConcurrency(t *testing.T) {
+	alice := newIdentity(t)
+	bob := newIdentity(t)
+
+	buf := &bytes.Buffer{}
+	for i := 0; i < 50; i++ {
+		recipient := alice.Recipient()
+		if i%3 == 0 {
+			recipient = bob.Recipient()
+		}
+		writeBlock(t, buf, []string{fmt.Sprintf("KEY_%d=%d", i%7, i), fmt.Sprintf("BLOCK_%d=%d", i, i)}, recipient)
+	}
+	data := buf.Bytes()
+
+	// the entries as returned by Next, one block at a time
+	var want []Entry
+	index := map[string]int{}
+	r := NewReader(bytes.NewReader(data), alice)
+	for {
+		e, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if i, exists := index[e.Key]; exists {
+			want[i] = e
+			continue
+		}
+		index[e.Key] = len(want)
+		want = append(want, e)
+	}
+
+	for _, concurrency := range []int{0, 1, 4, 100} {
+		r := NewReader(bytes.NewReader(data), alice)
+		r.Concurrency = concurrency
+		got, err := r.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", want) {
+			t.Errorf("concurrency %d: got %#v, want %#v", concurrency, got, want)
+		}
+	}
+
+	// an invalid header is reported even if later blocks can be decrypted
+	invalid := append([]byte("# ace/v9:AAAA\nA=AAAA\n\n"), data...)
+	if _, err := NewReader(bytes.NewReader(invalid), alice).ReadAll(); err == nil {
+		t.Error("expected an error for the invalid header")
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	alice := newIdentity(t)
+	bob := newIdentity(t)
+
+	buf := &bytes.Buffer{}
+	writeBlock(t, buf, []string{"A=1"}, alice.Recipient())
+	writeBlock(t, buf, []string{"B=2", "C=3"}, bob.Recipient())
+	writeBlock(t, buf, []string{"A=4"}, alice.Recipient(), bob.Recipient())
+	writeBlock(t, buf, []string{"D=5"}, bob.Recipient())
+
+	want := []SkippedBlock{{Block: 2, Line: 4, Keys: []string{"B", "C"}}, {Block: 4, Line: 11, Keys: []string{"D"}}}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()), alice)
+	if _, err := r.ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Skipped, want) {
+		t.Errorf("ReadAll: got %+v, want %+v", r.Skipped, want)
+	}
+
+	r = NewReader(bytes.NewReader(buf.Bytes()), alice)
+	for {
+		_, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(r.Skipped, want) {
+		t.Errorf("Next: got %+v, want %+v", r.Skipped, want)
+	}
+}
+
+// BenchmarkReadAll compares decrypting the block keys one at a time with
+// decrypting them in parallel, using several identities of which only the
+// last one matches.
+func BenchmarkReadAll(b *testing.B) {
+	identities := []age.Identity{newIdentity(b), newIdentity(b), newIdentity(b)}
+	alice := newIdentity(b)
+	identities = append(identities, alice)
+
+	buf := &bytes.Buffer{}
+	for i := 0; i < 500; i++ {
+		writeBlock(b, buf, []string{fmt.Sprintf("KEY_%d=%d", i%10, i)}, alice.Recipient())
+	}
+	data := buf.Bytes()
+
+	for _, concurrency := range []int{1, 0} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				r := NewReader(bytes.NewReader(data), identities...)
+				r.Concurrency = concurrency
+				if _, err := r.ReadAll(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type mapKeyCache struct {
+	mu   sync.Mutex
+	keys map[[sha256.Size]byte][]byte
+}
+
+func (c *mapKeyCache) Get(hash [sha256.Size]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[hash]
+	return key, ok
+}
+
+func (c *mapKeyCache) Put(hash [sha256.Size]byte, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[hash] = key
+}
+
+func TestCachingIdentity(t *testing.T) {
+	alice := newIdentity(t)
+	bob := newIdentity(t)
+
+	buf := &bytes.Buffer{}
+	writeBlock(t, buf, []string{"A=1"}, alice.Recipient())
+	writeBlock(t, buf, []string{"B=2"}, bob.Recipient())
+	writeBlock(t, buf, []string{"C=3"}, alice.Recipient(), bob.Recipient())
+
+	cache := &mapKeyCache{keys: map[[sha256.Size]byte][]byte{}}
+	read := func(want string, wantUnwraps int) {
+		t.Helper()
+		id := &countingIdentity{X25519Identity: alice}
+		entries, err := NewReader(bytes.NewReader(buf.Bytes()), NewCachingIdentity(cache, id)).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(entries) != want {
+			t.Errorf("unexpected entries %v", entries)
+		}
+		if id.unwraps != wantUnwraps {
+			t.Errorf("decrypted %d headers, want %d", id.unwraps, wantUnwraps)
+		}
+	}
+
+	read("[A=1 C=3]", 3)
+	if len(cache.keys) != 2 {
+		t.Errorf("expected 2 cached keys, got %d", len(cache.keys))
+	}
+	// only the block which can not be decrypted is tried again
+	read("[A=1 C=3]", 1)
+
+	writeBlock(t, buf, []string{"D=4"}, alice.Recipient())
+	read("[A=1 C=3 D=4]", 2)
+
+	// keys unwrapped by another identity are not used
+	entries, err := NewReader(bytes.NewReader(buf.Bytes()), NewCachingIdentity(cache, alice, bob)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(entries) != "[A=1 B=2 C=3 D=4]" {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	read("[A=1 C=3 D=4]", 1)
+	// bob only reuses the key of the block it unwrapped itself
+	id := &countingIdentity{X25519Identity: bob}
+	entries, err = NewReader(bytes.NewReader(buf.Bytes()), NewCachingIdentity(cache, id)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(entries) != "[B=2 C=3]" || id.unwraps != 3 {
+		t.Errorf("unexpected entries %v after %d unwraps", entries, id.unwraps)
+	}
+
+	// a wrong key fails to verify the header and is replaced
+	for hash := range cache.keys {
+		cache.keys[hash] = make([]byte, 16)
+	}
+	read("[A=1 C=3 D=4]", 4)
+	read("[A=1 C=3 D=4]", 1)
+}
+
+func TestCheck(t *testing.T) {
+	alice := newIdentity(t)
+	buf := &bytes.Buffer{}
+	writeBlock(t, buf, []string{"A=1", "B=2"}, alice.Recipient())
+	block := buf.String()
+	lines := strings.Split(block, "\n")
+	header, entry := lines[0], lines[1]
+
+	tests := []struct {
+		name       string
+		data       string
+		problems   []string
+		complete   int
+		terminator string
+	}{
+		{"valid", block + block, nil, 2 * len(block), ""},
+		{"empty", "", nil, 0, ""},
+		{"orphan header", header + "\n\n" + block, []string{"line 1: orphan header without any values"}, 2 + len(header) + len(block), ""},
+		{"orphan header before block", header + "\n" + block, []string{"line 1: orphan header without any values"}, 1 + len(header) + len(block), ""},
+		{"orphan header at the end", block + header + "\n", []string{"line 5: orphan header without any values"}, len(block), ""},
+		{"partial line", block + header + "\n" + entry[:7], []string{
+			"line 6: partial line, the file does not end with a newline",
+			"line 6: undecodable value of A: " + entryErr(entry[:7]),
+			"line 6: missing blank line at the end of the block",
+		}, len(block), ""},
+		{"partial value", block + header + "\n" + entry[:10], []string{
+			"line 6: partial line, the file does not end with a newline",
+			"line 6: missing blank line at the end of the block",
+		}, len(block), ""},
+		{"missing newline", block + header + "\n" + entry, []string{
+			"line 6: partial line, the file does not end with a newline",
+			"line 6: missing blank line at the end of the block",
+		}, len(block), ""},
+		{"missing blank line", block + header + "\n" + entry + "\n", []string{"line 6: missing blank line at the end of the block"}, len(block) + len(header) + 2 + len(entry), "\n"},
+		{"missing blank line before block", header + "\n" + entry + "\n" + block, []string{"line 2: missing blank line at the end of the block"}, 2 + len(header) + len(entry) + len(block), ""},
+		{"undecodable value", header + "\nA=@@@\n\n" + block, []string{"line 2: undecodable value of A: " + entryErr("A=@@@")}, 8 + len(header) + len(block), ""},
+		{"undecodable header", "# ace/v1:@@@\n" + entry + "\n\n", []string{"line 1: undecodable header: illegal base32 data at input byte 0"}, 0, ""},
+		{"unsupported version", "# ace/v9:AAAA\n" + entry + "\n\n", []string{"line 1: unsupported format version v9, the block was written by a newer version of ace"}, 0, ""},
+		{"comment like a header", "# ace/version 3\n\n" + block, nil, 17 + len(block), ""},
+		{"outside of a block", "A=1\n" + block, []string{"line 1: line outside of a block"}, 4 + len(block), ""},
+		{"comments", "# comment\n\n" + block, nil, 11 + len(block), ""},
+		{"trailing comments", block + "# comment\n\n", nil, 11 + len(block), ""},
+		{"partial comment", block + "# comment", []string{"line 5: partial line, the file does not end with a newline"}, len(block), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := Check(strings.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var problems []string
+			for _, p := range report.Problems {
+				problems = append(problems, p.String())
+			}
+			if !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("got problems %q, want %q", problems, tt.problems)
+			}
+			if report.Complete != int64(tt.complete) {
+				t.Errorf("got complete %d, want %d", report.Complete, tt.complete)
+			}
+			if report.Terminator != tt.terminator {
+				t.Errorf("got terminator %q, want %q", report.Terminator, tt.terminator)
+			}
+			if report.Size != int64(len(tt.data)) {
+				t.Errorf("got size %d, want %d", report.Size, len(tt.data))
+			}
+		})
+	}
+}
+
+// entryErr returns the error decoding the value of a v1 entry.
+func entryErr(entry string) string {
+	_, value, _ := strings.Cut(entry, "=")
+	_, err := V1.encoding().DecodeString(value)
+	return err.Error()
+}
+
+// countingIdentity counts the block keys it is asked to decrypt.
+type countingIdentity struct {
+	*age.X25519Identity
+	unwraps int
+}
+
+func (i *countingIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	i.unwraps++
+	return i.X25519Identity.Unwrap(stanzas)
+}
+
+func TestLookup(t *testing.T) {
+	alice := newIdentity(t)
+	bob := newIdentity(t)
+
+	buf := &bytes.Buffer{}
+	writeBlock(t, buf, []string{"A=1", "B=1"}, alice.Recipient())
+	writeBlock(t, buf, []string{"A=2", "C=secret"}, bob.Recipient())
+	w := NewWriter(buf, alice.Recipient())
+	w.Format = V1
+	if err := w.Set("LARGE", strings.Repeat("x", 3*reverseChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetBinary("BIN", []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writeBlock(t, buf, []string{"B=3", "D=3"}, alice.Recipient())
+	data := buf.Bytes()
+
+	tests := []struct {
+		keys    []string
+		want    []string
+		unwraps int
+	}{
+		{[]string{"D"}, []string{"D=3"}, 1},
+		{[]string{"D", "B"}, []string{"D=3", "B=3"}, 1},
+		// blocks which do not set any of the keys are skipped
+		{[]string{"A", "D"}, []string{"A=1", "D=3"}, 3},
+		{[]string{"A", "A"}, []string{"A=1"}, 2},
+		{[]string{"C", "MISSING"}, nil, 1},
+		{[]string{"BIN"}, []string{"BIN=\x00\x01\x02"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.keys, ","), func(t *testing.T) {
+			id := &countingIdentity{X25519Identity: alice}
+			entries, err := Lookup(bytes.NewReader(data), int64(len(data)), tt.keys, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.String())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if id.unwraps != tt.unwraps {
+				t.Errorf("decrypted %d block keys, want %d", id.unwraps, tt.unwraps)
+			}
+		})
+	}
+
+	entries, err := Lookup(bytes.NewReader(data), int64(len(data)), []string{"LARGE"}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Value != strings.Repeat("x", 3*reverseChunkSize) {
+		t.Errorf("LARGE does not match")
+	}
+}
+
+// BenchmarkLookup compares reading a single key set in the last block with
+// reading the whole file.
+func BenchmarkLookup(b *testing.B) {
+	alice := newIdentity(b)
+	for _, blocks := range []int{1000, 5000} {
+		buf := &bytes.Buffer{}
+		for i := 0; i < blocks; i++ {
+			writeBlock(b, buf, []string{fmt.Sprintf("KEY_%d=%d", i%10, i)}, alice.Recipient())
+		}
+		data := buf.Bytes()
+		key := fmt.Sprintf("KEY_%d", (blocks-1)%10)
+
+		b.Run(fmt.Sprintf("blocks=%d/ReadAll", blocks), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := NewReader(bytes.NewReader(data), alice).ReadAll(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("blocks=%d/Lookup", blocks), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Lookup(bytes.NewReader(data), int64(len(data)), []string{key}, alice); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func TestQuoteValue(t *testing.T) {
+	values := []string{
+		"",
+		"plain",
+		"with spaces ",
+		"'single'",
+		`"double"`,
+		"  'leading space",
+		"line1\nline2",
+		"$HOME `cmd` \\ \"",
+	}
+	for _, v := range values {
+		quoted := QuoteValue(v)
+		got, err := UnescapeValue(quoted)
+		if err != nil {
+			t.Fatalf("%q: %v", quoted, err)
+		}
+		if got != v {
+			t.Errorf("expected %q to round trip through %q, got %q", v, quoted, got)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	id := newIdentity(t)
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	if err := os.MkdirAll(filepath.Join(config, "ace"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config, "ace", "identity"), []byte(id.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	shared := &bytes.Buffer{}
+	writeBlock(t, shared, []string{"ACE_LOAD_A=shared", "ACE_LOAD_B='quoted value'", "ACE_LOAD_C=shared"}, id.Recipient())
+	if err := os.WriteFile(filepath.Join(dir, "shared.ace"), shared.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	local := &bytes.Buffer{}
+	writeBlock(t, local, []string{"ACE_LOAD_C=local"}, id.Recipient())
+	if err := os.WriteFile(filepath.Join(dir, "local.ace"), local.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	unset := func(keys ...string) {
+		for _, k := range keys {
+			// restores the original environment after the test
+			t.Setenv(k, "")
+			os.Unsetenv(k)
+		}
+	}
+
+	t.Run("load", func(t *testing.T) {
+		unset("ACE_LOAD_B", "ACE_LOAD_C")
+		t.Setenv("ACE_LOAD_A", "parent")
+		err := Load(filepath.Join(dir, "shared.ace"), filepath.Join(dir, "local.ace"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range map[string]string{"ACE_LOAD_A": "parent", "ACE_LOAD_B": "quoted value", "ACE_LOAD_C": "local"} {
+			if got := os.Getenv(k); got != v {
+				t.Errorf("expected %s=%q, got %q", k, v, got)
+			}
+		}
+	})
+
+	t.Run("overload", func(t *testing.T) {
+		unset("ACE_LOAD_B", "ACE_LOAD_C")
+		t.Setenv("ACE_LOAD_A", "parent")
+		err := Overload(filepath.Join(dir, "shared.ace"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := os.Getenv("ACE_LOAD_A"); got != "shared" {
+			t.Errorf("expected ACE_LOAD_A to be overridden, got %q", got)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		err := Load(filepath.Join(dir, "missing.ace"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected a not exist error, got %v", err)
+		}
+	})
+}
+
+func TestFS(t *testing.T) {
+	fsys, err := NewFS([]Entry{
+		{Key: "A", Value: "1"},
+		{Key: "CERT", Value: "\"line1\nline2\""},
+		{Key: "A", Value: "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "A", "CERT"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "CERT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "line1\nline2" {
+		t.Errorf("unexpected CERT %q", data)
+	}
+	data, err = fs.ReadFile(fsys, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "2" {
+		t.Errorf("unexpected A %q", data)
+	}
+
+	_, err = NewFS([]Entry{{Key: "../A", Value: "1"}})
+	if err == nil {
+		t.Error("expected invalid file name error")
+	}
+}
@@ -0,0 +1,116 @@
+package acefile
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"filippo.io/age"
+)
+
+// KeyCache stores the keys unwrapped from the headers of blocks, by the hash
+// of the header and the identity which unwrapped it, so that each header only
+// needs to be decrypted with an identity once. Implementations must be safe
+// for concurrent use.
+type KeyCache interface {
+	Get(hash [sha256.Size]byte) (key []byte, ok bool)
+	Put(hash [sha256.Size]byte, key []byte)
+}
+
+// NewCachingIdentity returns an identity which looks up the key of a header in
+// cache, and otherwise unwraps it with the first of identities which matches
+// and stores it in cache. Headers which none of the identities match are not
+// cached and are tried again the next time.
+//
+// A cached key is only used if the identity which unwrapped it is one of
+// identities, so the same cache can be shared by different sets of
+// identities. Only the keys of X25519 identities, or of identities with a
+// Recipient() *age.X25519Recipient method, are cached. If a cached key turns
+// out to be wrong the header is decrypted with identities again.
+//
+// Use it in place of identities with a Reader or Lookup.
+func NewCachingIdentity(cache KeyCache, identities ...age.Identity) age.Identity {
+	return &cachingIdentity{cache: cache, identities: identities}
+}
+
+type cachingIdentity struct {
+	cache      KeyCache
+	identities []age.Identity
+	// refresh skips the lookup of keys which turned out to be wrong
+	refresh bool
+}
+
+// x25519Identity is implemented by *age.X25519Identity.
+type x25519Identity interface {
+	Recipient() *age.X25519Recipient
+}
+
+// cacheHash returns the hash id caches the key of stanzas by, ok is false if
+// id can not be cached.
+func cacheHash(id age.Identity, stanzas []*age.Stanza) (hash [sha256.Size]byte, ok bool) {
+	x, ok := id.(x25519Identity)
+	if !ok {
+		return hash, false
+	}
+	return hashStanzas(x.Recipient().String(), stanzas), true
+}
+
+func (c *cachingIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if !c.refresh {
+		for _, id := range c.identities {
+			if hash, ok := cacheHash(id, stanzas); ok {
+				if key, ok := c.cache.Get(hash); ok {
+					return key, nil
+				}
+			}
+		}
+	}
+	for _, id := range c.identities {
+		key, err := id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if hash, ok := cacheHash(id, stanzas); ok {
+			c.cache.Put(hash, key)
+		}
+		return key, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// refreshed returns identities with the caching identities replaced by ones
+// which do not use the cached keys, ok is false if there are none.
+func refreshed(identities []age.Identity) (refreshed []age.Identity, ok bool) {
+	for _, id := range identities {
+		if c, isCaching := id.(*cachingIdentity); isCaching && !c.refresh {
+			id = &cachingIdentity{cache: c.cache, identities: c.identities, refresh: true}
+			ok = true
+		}
+		refreshed = append(refreshed, id)
+	}
+	return refreshed, ok
+}
+
+// hashStanzas returns the hash of the recipient of an identity and the
+// recipient stanzas of an age header.
+func hashStanzas(recipient string, stanzas []*age.Stanza) [sha256.Size]byte {
+	h := sha256.New()
+	write := func(b []byte) {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+		h.Write(b)
+	}
+	write([]byte(recipient))
+	for _, s := range stanzas {
+		write([]byte(s.Type))
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(s.Args))))
+		for _, arg := range s.Args {
+			write([]byte(arg))
+		}
+		write(s.Body)
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
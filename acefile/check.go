@@ -0,0 +1,194 @@
+package acefile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Problem is an issue found by Check.
+type Problem struct {
+	// Line is the 1-based line number of the problem.
+	Line    int
+	Message string
+	// Repairable is set if the problem goes away when the file is truncated
+	// to Report.Complete and Report.Terminator is appended.
+	Repairable bool
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// Report is the result of Check.
+type Report struct {
+	Problems []Problem
+	// Size is the number of bytes read.
+	Size int64
+	// Complete is the offset right after the last complete block and any
+	// comments and blank lines following it, the file can be truncated to it
+	// to remove an interrupted write.
+	Complete int64
+	// Lines is the number of lines up to Complete.
+	Lines int
+	// Terminator is appended at Complete to end the last block if it is
+	// complete but misses its trailing blank line.
+	Terminator string
+}
+
+// Check reads an env file and reports problems with its structure, such as
+// headers without any values, lines cut short by an interrupted write,
+// values which can not be decoded and blocks which do not end with a blank
+// line. Nothing is decrypted, so no identities are needed.
+func Check(r io.Reader) (*Report, error) {
+	c := &checker{report: &Report{}}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			c.line(line)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	c.eof = true
+	c.endBlock(c.num+1, false)
+	for i, p := range c.report.Problems {
+		if p.Line > c.report.Lines {
+			c.report.Problems[i].Repairable = true
+		}
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	report *Report
+	num    int
+	offset int64
+	eof    bool
+
+	// the block being read, header is 0 when outside of a block
+	header  int
+	enc     encoding
+	entries int
+	valid   bool
+}
+
+func (c *checker) problem(line int, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, Problem{Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// repairable marks the problems at line num as repairable.
+func (c *checker) repairable(num int) {
+	for i, p := range c.report.Problems {
+		if p.Line == num {
+			c.report.Problems[i].Repairable = true
+		}
+	}
+}
+
+// complete moves Report.Complete to the end of the current line.
+func (c *checker) complete() {
+	c.report.Complete = c.offset
+	c.report.Lines = c.num
+	c.report.Terminator = ""
+}
+
+func (c *checker) line(raw string) {
+	start := c.offset
+	c.num++
+	c.offset += int64(len(raw))
+	c.report.Size = c.offset
+
+	// a line without a newline may have been cut anywhere, even where the
+	// value still decodes, so it is never kept
+	partial := !strings.HasSuffix(raw, "\n")
+	if partial {
+		c.problem(c.num, "partial line, the file does not end with a newline")
+		c.valid = false
+	}
+	line := strings.TrimSpace(raw)
+
+	switch {
+	case isHeader(line):
+		if c.header > 0 {
+			c.endBlock(c.num, false)
+		}
+		c.header = c.num
+		c.entries = 0
+		c.valid = true
+		format, header, err := parseHeader(line)
+		if err != nil {
+			c.problem(c.num, "%v", err)
+			c.valid = false
+			return
+		}
+		c.enc = format.encoding()
+		if _, err := c.enc.DecodeString(header); err != nil {
+			c.problem(c.num, "undecodable header: %v", err)
+			c.valid = false
+		}
+
+	case line == "":
+		if c.header > 0 {
+			c.endBlock(c.num, true)
+		} else if start == c.report.Complete && !partial {
+			c.complete()
+		}
+
+	case strings.HasPrefix(line, "#"):
+		// comments following a complete block are kept
+		if c.header == 0 && start == c.report.Complete && !partial {
+			c.complete()
+		}
+
+	case c.header == 0:
+		c.problem(c.num, "line outside of a block")
+
+	default:
+		c.entries++
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			c.problem(c.num, "invalid line, expected KEY=VALUE")
+			c.valid = false
+			return
+		}
+		if c.enc == nil {
+			return
+		}
+		if _, err := c.enc.DecodeString(value); err != nil {
+			c.problem(c.num, "undecodable value of %s: %v", strings.TrimSuffix(key, BinarySuffix), err)
+			c.valid = false
+		}
+	}
+}
+
+// endBlock finishes the current block at line num. terminated is set if the
+// block ends with a blank line. A valid block at the end of the file whose
+// last line ends with a newline and which only misses its blank line is
+// complete, it is repaired by appending one.
+func (c *checker) endBlock(num int, terminated bool) {
+	if c.header == 0 {
+		return
+	}
+	switch {
+	case c.entries == 0:
+		c.problem(c.header, "orphan header without any values")
+	case !terminated:
+		c.problem(num-1, "missing blank line at the end of the block")
+		if c.eof && c.valid {
+			c.complete()
+			c.report.Terminator = "\n"
+			c.repairable(c.num)
+		}
+	case c.valid:
+		c.complete()
+	}
+	c.header = 0
+	c.enc = nil
+}
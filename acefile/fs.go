@@ -0,0 +1,110 @@
+package acefile
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NewFS returns a read-only file system with one file per entry, named after
+// its key and holding its unescaped value or raw bytes. Later entries with the
+// same key override earlier ones.
+func NewFS(entries []Entry) (fs.FS, error) {
+	files := mapFS{}
+	for _, e := range entries {
+		if !fs.ValidPath(e.Key) || strings.Contains(e.Key, "/") || e.Key == "." {
+			return nil, fmt.Errorf("invalid file name %q", e.Key)
+		}
+		v, err := e.Unescaped()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Key, err)
+		}
+		files[e.Key] = []byte(v)
+	}
+	return files, nil
+}
+
+type mapFS map[string][]byte
+
+func (m mapFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		var entries []fs.DirEntry
+		for n, data := range m {
+			entries = append(entries, fs.FileInfoToDirEntry(fileInfo{name: n, size: int64(len(data))}))
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		return &dir{entries: entries}, nil
+	}
+	data, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &file{info: fileInfo{name: name, size: int64(len(data))}, r: strings.NewReader(string(data))}, nil
+}
+
+func (m mapFS) ReadFile(name string) ([]byte, error) {
+	if data, ok := m[name]; ok {
+		return append([]byte(nil), data...), nil
+	}
+	return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() any           { return nil }
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o500
+	}
+	return 0o400
+}
+
+type file struct {
+	info fileInfo
+	r    *strings.Reader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *file) Close() error               { return nil }
+
+type dir struct {
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return fileInfo{name: ".", dir: true}, nil }
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: fs.ErrInvalid}
+}
+func (d *dir) Close() error { return nil }
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,121 @@
+package acefile
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+)
+
+// DefaultFile is the env file loaded when no file names are given.
+const DefaultFile = ".env.ace"
+
+// DefaultIdentityFile returns the path of the identity used by ace when none
+// is specified, `$XDG_CONFIG_HOME/ace/identity`.
+func DefaultIdentityFile() (string, error) {
+	dir, exists := os.LookupEnv("XDG_CONFIG_HOME")
+	if !exists {
+		var err error
+		dir, err = os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("unable to read user config dir: %w", err)
+		}
+	}
+	return filepath.Join(dir, "ace", "identity"), nil
+}
+
+// ReadIdentities parses the age identities in each of the files.
+func ReadIdentities(filenames ...string) ([]age.Identity, error) {
+	var identities []age.Identity
+	for _, name := range filenames {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		identities = append(identities, ids...)
+	}
+	return identities, nil
+}
+
+// Load decrypts the env files with the identity of DefaultIdentityFile and
+// sets the variables in the environment of the current process. Unlike the
+// ace command, it does not read the identities of the project config.
+// Variables which are already set are not overridden. Later files override
+// earlier ones. It defaults to loading DefaultFile in the working directory.
+// Binary values are set base64 encoded.
+func Load(filenames ...string) error {
+	return load(false, filenames)
+}
+
+// Overload is like Load but overrides variables which are already set.
+func Overload(filenames ...string) error {
+	return load(true, filenames)
+}
+
+func load(override bool, filenames []string) error {
+	if len(filenames) == 0 {
+		filenames = []string{DefaultFile}
+	}
+
+	identityFile, err := DefaultIdentityFile()
+	if err != nil {
+		return err
+	}
+	identities, err := ReadIdentities(identityFile)
+	if err != nil {
+		return err
+	}
+
+	vals := map[string]string{}
+	var keys []string
+	for _, name := range filenames {
+		entries, err := readFile(name, identities)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if _, exists := vals[e.Key]; !exists {
+				keys = append(keys, e.Key)
+			}
+			if e.Binary {
+				vals[e.Key] = base64.StdEncoding.EncodeToString([]byte(e.Value))
+				continue
+			}
+			vals[e.Key], err = UnescapeValue(e.Value)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", name, e.Key, err)
+			}
+		}
+	}
+
+	for _, k := range keys {
+		if _, exists := os.LookupEnv(k); exists && !override {
+			continue
+		}
+		if err := os.Setenv(k, vals[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(name string, identities []age.Identity) ([]Entry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := NewReader(f, identities...).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,162 @@
+package acefile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Lookup returns the newest entry of each of keys in the file r of size
+// bytes, in the order of keys. Keys which are not set are left out.
+//
+// Unlike a Reader, which decrypts every block it passes, Lookup reads the
+// blocks from the end of the file and stops as soon as all keys are found,
+// which makes it much cheaper on files with a long history. Only the values
+// of the requested keys are decrypted. As blocks are only ever appended and
+// the format has no tombstones to unset a key, the newest appearance of a key
+// is its value.
+//
+// The Block and Line of the returned entries are not known without reading
+// the whole file and are left zero.
+func Lookup(r io.ReaderAt, size int64, keys []string, identities ...age.Identity) ([]Entry, error) {
+	found := map[string]Entry{}
+	wanted := map[string]bool{}
+	for _, k := range keys {
+		wanted[k] = true
+	}
+
+	lines := &reverseLines{r: r, off: size}
+	var block []string
+	for len(found) < len(wanted) {
+		line, err := lines.prev()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+
+		if !isHeader(line) {
+			// collect the lines of the block until its header is found,
+			// ignoring comments and lines without a value
+			if !strings.HasPrefix(line, "#") && strings.Contains(line, "=") {
+				block = append(block, line)
+			}
+			continue
+		}
+
+		// block holds the lines in reverse so the last value of a key within
+		// the block is seen first
+		lookup := block
+		block = nil
+		if !hasWanted(lookup, wanted, found) {
+			// no need to decrypt the block key
+			continue
+		}
+
+		format, header, err := parseHeader(line)
+		if err != nil {
+			return nil, err
+		}
+		enc := format.encoding()
+		aead, err := openBlock(enc, header, identities)
+		if err != nil {
+			return nil, err
+		} else if aead == nil {
+			continue
+		}
+
+		for _, l := range lookup {
+			k, v, _ := strings.Cut(l, "=")
+			key, binary := strings.CutSuffix(k, BinarySuffix)
+			if _, done := found[key]; done || !wanted[key] {
+				continue
+			}
+			plaintext, err := decryptValue(aead, enc, v)
+			if err != nil {
+				return nil, err
+			}
+			found[key] = Entry{Key: key, Value: string(plaintext), Binary: binary}
+		}
+	}
+
+	var entries []Entry
+	for _, k := range keys {
+		if e, ok := found[k]; ok {
+			entries = append(entries, e)
+			// skip duplicates in keys
+			delete(found, k)
+		}
+	}
+	return entries, nil
+}
+
+// hasWanted reports whether any of the lines sets a key which is wanted but
+// not found yet.
+func hasWanted(lines []string, wanted map[string]bool, found map[string]Entry) bool {
+	for _, l := range lines {
+		k, _, _ := strings.Cut(l, "=")
+		key := strings.TrimSuffix(k, BinarySuffix)
+		if _, done := found[key]; wanted[key] && !done {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseChunkSize is the number of bytes reverseLines reads at a time.
+const reverseChunkSize = 64 * 1024
+
+// reverseLines returns the lines of a file starting with the last one.
+type reverseLines struct {
+	r io.ReaderAt
+	// off is the offset of buf in the file
+	off int64
+	// buf holds the lines before off+len(buf) which have not been returned
+	buf []byte
+}
+
+// prev returns the line before the last one returned, or io.EOF at the start
+// of the file.
+func (l *reverseLines) prev() (string, error) {
+	if len(l.buf) == 0 {
+		if l.off == 0 {
+			return "", io.EOF
+		}
+		if err := l.fill(); err != nil {
+			return "", err
+		}
+	}
+	// drop the newline ending the line
+	l.buf = bytes.TrimSuffix(l.buf, []byte("\n"))
+	for {
+		if i := bytes.LastIndexByte(l.buf, '\n'); i >= 0 {
+			line := string(l.buf[i+1:])
+			l.buf = l.buf[:i+1]
+			return line, nil
+		}
+		if l.off == 0 {
+			line := string(l.buf)
+			l.buf = nil
+			return line, nil
+		}
+		if err := l.fill(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// fill prepends the chunk of the file before buf.
+func (l *reverseLines) fill() error {
+	n := min(int64(reverseChunkSize), l.off)
+	chunk := make([]byte, n, n+int64(len(l.buf)))
+	if _, err := l.r.ReadAt(chunk, l.off-n); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	l.off -= n
+	l.buf = append(chunk, l.buf...)
+	return nil
+}
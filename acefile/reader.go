@@ -0,0 +1,276 @@
+package acefile
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Reader reads the entries of an env file which can be decrypted by any of
+// its identities. Blocks which were not encrypted to any of the identities
+// are skipped.
+type Reader struct {
+	// Concurrency is the number of block keys ReadAll decrypts in parallel.
+	// Defaults to GOMAXPROCS.
+	Concurrency int
+
+	// Skipped lists the blocks read so far which could not be decrypted with
+	// any of the identities.
+	Skipped []SkippedBlock
+
+	r          *bufio.Reader
+	identities []age.Identity
+	aead       cipher.AEAD
+	enc        encoding
+	block      int
+	line       int
+}
+
+// SkippedBlock is a block which could not be decrypted. The names of the keys
+// are not encrypted and are known all the same.
+type SkippedBlock struct {
+	// Block is the 1-based index of the block.
+	Block int
+	// Line is the 1-based line number of the header of the block.
+	Line int
+	Keys []string
+}
+
+func NewReader(r io.Reader, identities ...age.Identity) *Reader {
+	return &Reader{r: bufio.NewReader(r), identities: identities}
+}
+
+// Next returns the next entry in the file, or io.EOF when there are no more
+// entries.
+func (r *Reader) Next() (Entry, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return Entry{}, err
+		}
+		line = strings.TrimSpace(line)
+		r.line++
+
+		// split on the header of each block
+		if isHeader(line) {
+			r.block++
+			format, header, err := parseHeader(line)
+			if err != nil {
+				return Entry{}, err
+			}
+			r.enc = format.encoding()
+			r.aead, err = openBlock(r.enc, header, r.identities)
+			if err != nil {
+				return Entry{}, err
+			}
+			if r.aead == nil {
+				r.Skipped = append(r.Skipped, SkippedBlock{Block: r.block, Line: r.line})
+			}
+		}
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// decrypt each secret using block key
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+
+		key, binary := strings.CutSuffix(pair[0], BinarySuffix)
+		if r.aead == nil {
+			if n := len(r.Skipped); n > 0 && r.Skipped[n-1].Block == r.block {
+				r.Skipped[n-1].Keys = append(r.Skipped[n-1].Keys, key)
+			}
+			continue
+		}
+
+		plaintext, err := decryptValue(r.aead, r.enc, pair[1])
+		if err != nil {
+			return Entry{}, err
+		}
+		return Entry{Key: key, Value: string(plaintext), Binary: binary, Block: r.block, Line: r.line}, nil
+	}
+}
+
+// readLine returns the next line of any length, or io.EOF when there are no
+// more lines.
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if errors.Is(err, io.EOF) && line != "" {
+		return line, nil
+	}
+	return line, err
+}
+
+// ReadAll returns the remaining entries of the file in order of first
+// appearance, with the value of the last appearance. After calls to Next it
+// continues with the rest of the current block.
+//
+// Decrypting the block key of each block with every identity dominates the
+// time it takes to read a file with many blocks, so ReadAll reads all blocks
+// first and decrypts their block keys in parallel.
+func (r *Reader) ReadAll() ([]Entry, error) {
+	blocks, err := r.readBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, b := range blocks {
+		if b.err != nil || b.opened {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			b.aead, b.err = openBlock(b.enc, b.header, r.identities)
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	// decrypt the values in order so later values override earlier ones
+	var entries []Entry
+	index := map[string]int{}
+	for _, b := range blocks {
+		if b.err != nil {
+			return nil, b.err
+		}
+		if b.aead == nil {
+			if !b.opened {
+				r.Skipped = append(r.Skipped, SkippedBlock{Block: b.index, Line: b.line})
+			}
+			// the block being read by Next was already added
+			skipped := &r.Skipped[len(r.Skipped)-1]
+			for _, l := range b.lines {
+				k, _, _ := strings.Cut(l.text, "=")
+				skipped.Keys = append(skipped.Keys, strings.TrimSuffix(k, BinarySuffix))
+			}
+			continue
+		}
+		for _, l := range b.lines {
+			k, v, _ := strings.Cut(l.text, "=")
+			key, binary := strings.CutSuffix(k, BinarySuffix)
+			plaintext, err := decryptValue(b.aead, b.enc, v)
+			if err != nil {
+				return nil, err
+			}
+			e := Entry{Key: key, Value: string(plaintext), Binary: binary, Block: b.index, Line: l.num}
+
+			if i, exists := index[e.Key]; exists {
+				entries[i] = e
+				continue
+			}
+			index[e.Key] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// block is a block of encrypted lines read by readBlocks.
+type block struct {
+	index  int
+	line   int
+	enc    encoding
+	header string
+	lines  []blockLine
+	aead   cipher.AEAD
+	// opened is set for the block Next was reading, whose key is already
+	// decrypted
+	opened bool
+	// err is set if the header is invalid, and reported once the block is
+	// reached in order
+	err error
+}
+
+type blockLine struct {
+	text string
+	num  int
+}
+
+// readBlocks reads the remaining blocks without decrypting them, starting
+// with the rest of the block Next was reading. Lines before the first block
+// are skipped, like Next does.
+func (r *Reader) readBlocks() ([]*block, error) {
+	var blocks []*block
+	var current *block
+	if r.block > 0 {
+		current = &block{index: r.block, enc: r.enc, aead: r.aead, opened: true}
+		if n := len(r.Skipped); n > 0 && r.Skipped[n-1].Block == r.block {
+			current.line = r.Skipped[n-1].Line
+		}
+		blocks = append(blocks, current)
+	}
+	for {
+		line, err := r.readLine()
+		if errors.Is(err, io.EOF) {
+			return blocks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		r.line++
+
+		if isHeader(line) {
+			r.block++
+			current = &block{index: r.block, line: r.line}
+			blocks = append(blocks, current)
+			var format Format
+			format, current.header, current.err = parseHeader(line)
+			current.enc = format.encoding()
+		}
+
+		if strings.HasPrefix(line, "#") || !strings.Contains(line, "=") || current == nil {
+			continue
+		}
+		current.lines = append(current.lines, blockLine{text: line, num: r.line})
+	}
+}
+
+// openBlock decrypts the block key in header. A nil AEAD is returned if none
+// of the identities match.
+func openBlock(enc encoding, header string, identities []age.Identity) (cipher.AEAD, error) {
+	// decode the age header
+	data, err := enc.DecodeString(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// decrypt the block key using identities
+	dec, err := age.Decrypt(bytes.NewReader(data), identities...)
+	var noMatch *age.NoIdentityMatchError
+	if err != nil && !errors.As(err, &noMatch) {
+		// a wrong cached key fails to verify the header, decrypt it again
+		if identities, ok := refreshed(identities); ok {
+			dec, err = age.Decrypt(bytes.NewReader(data), identities...)
+		}
+	}
+	if errors.As(err, &noMatch) {
+		// try next env block
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	blockKey, err := io.ReadAll(dec)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(blockKey)
+}
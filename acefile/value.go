@@ -0,0 +1,133 @@
+package acefile
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// CheckKey returns an error if key cannot be stored in an env file, because it
+// would be mistaken for a comment or break the line based format.
+func CheckKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("empty key")
+	case strings.TrimSpace(key) != key || strings.ContainsAny(key, "\r\n"):
+		return fmt.Errorf("invalid key %q: must not contain line breaks or surrounding whitespace", key)
+	case strings.Contains(key, "="):
+		return fmt.Errorf("invalid key %q: must not contain =", key)
+	case strings.HasSuffix(key, BinarySuffix):
+		return fmt.Errorf("invalid key %q: must not end with %s", key, BinarySuffix)
+	case key[0] == '#':
+		return fmt.Errorf("invalid key %q: must not start with #", key)
+	}
+	return nil
+}
+
+// UnescapeValue removes shell style quoting from a value. Values which do not
+// start with a quote are returned as is.
+func UnescapeValue(value string) (string, error) {
+	if len(value) == 0 {
+		return "", nil
+	}
+
+	trimmed := strings.TrimLeftFunc(value, unicode.IsSpace)
+	if len(trimmed) == 0 {
+		return value, nil
+	}
+	if trimmed[0] != '\'' && trimmed[0] != '"' {
+		return value, nil
+	}
+
+	var unescaped strings.Builder
+	var i int
+	state := "unquoted"
+
+	for i < len(value) {
+		c := value[i]
+
+		switch state {
+		case "unquoted":
+			if c == '\'' {
+				state = "singleQuoted"
+				i++
+			} else if c == '"' {
+				state = "doubleQuoted"
+				i++
+			} else if c == '\\' {
+				i++
+				if i >= len(value) {
+					return "", fmt.Errorf("unexpected end of string")
+				}
+				unescaped.WriteByte(value[i])
+				i++
+			} else {
+				unescaped.WriteByte(c)
+				i++
+			}
+		case "singleQuoted":
+			if c == '\'' {
+				state = "unquoted"
+				i++
+			} else {
+				unescaped.WriteByte(c)
+				i++
+			}
+		case "doubleQuoted":
+			if c == '"' {
+				state = "unquoted"
+				i++
+			} else if c == '\\' {
+				i++
+				if i >= len(value) {
+					return "", fmt.Errorf("unexpected end of string")
+				}
+				c2 := value[i]
+				switch c2 {
+				case '$', '`', '"', '\\', '\n':
+					unescaped.WriteByte(c2)
+				case 'n':
+					unescaped.WriteByte('\n')
+				case 't':
+					unescaped.WriteByte('\t')
+				default:
+					unescaped.WriteByte('\\')
+					unescaped.WriteByte(c2)
+				}
+				i++
+			} else {
+				unescaped.WriteByte(c)
+				i++
+			}
+		}
+	}
+
+	if state != "unquoted" {
+		return "", fmt.Errorf("unclosed quote in value")
+	}
+
+	return unescaped.String(), nil
+}
+
+// QuoteValue is the inverse of UnescapeValue. Values which would not survive
+// a round trip through UnescapeValue are wrapped in double quotes.
+func QuoteValue(value string) string {
+	trimmed := strings.TrimLeftFunc(value, unicode.IsSpace)
+	if !strings.Contains(value, "\n") && (trimmed == "" || (trimmed[0] != '\'' && trimmed[0] != '"')) {
+		return value
+	}
+
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '$', '`', '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
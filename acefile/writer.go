@@ -0,0 +1,110 @@
+package acefile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Writer appends blocks to an env file. Entries are buffered until Flush
+// which encrypts them to the recipients and writes the whole block at once.
+type Writer struct {
+	// Format of the blocks to write, defaults to V1 which every version of
+	// ace can read. Versions of ace before V2 fail to read the whole file
+	// once it has a V2 block.
+	Format Format
+
+	w          io.Writer
+	recipients []age.Recipient
+	entries    []Entry
+}
+
+func NewWriter(w io.Writer, recipients ...age.Recipient) *Writer {
+	return &Writer{Format: V1, w: w, recipients: recipients}
+}
+
+// Set adds an entry to the current block. The value is stored as is and must
+// be valid according to UnescapeValue, use QuoteValue to store any string.
+func (w *Writer) Set(key, value string) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	if _, err := UnescapeValue(value); err != nil {
+		return err
+	}
+	w.entries = append(w.entries, Entry{Key: key, Value: value})
+	return nil
+}
+
+// SetBinary adds an entry holding raw bytes to the current block.
+func (w *Writer) SetBinary(key string, value []byte) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	w.entries = append(w.entries, Entry{Key: key, Value: string(value), Binary: true})
+	return nil
+}
+
+// Flush encrypts the entries added since the last Flush as a new block and
+// writes it with a single Write. Nothing is written if there are no entries.
+func (w *Writer) Flush() error {
+	if len(w.entries) == 0 {
+		return nil
+	}
+
+	block, err := w.encryptBlock()
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(block); err != nil {
+		return err
+	}
+	w.entries = nil
+	return nil
+}
+
+func (w *Writer) encryptBlock() ([]byte, error) {
+	blockKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(blockKey); err != nil {
+		return nil, err
+	}
+
+	header := bytes.NewBuffer(nil)
+
+	// encrypt the key using age
+	ageWriter, err := age.Encrypt(header, w.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ageWriter.Write(blockKey); err != nil {
+		return nil, err
+	}
+	if err := ageWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(blockKey)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	enc := w.Format.encoding()
+	buf.WriteString(w.Format.prefix() + enc.EncodeToString(header.Bytes()) + "\n")
+	for _, e := range w.entries {
+		secret, err := encryptValue(aead, enc, []byte(e.Value))
+		if err != nil {
+			return nil, err
+		}
+		key := e.Key
+		if e.Binary {
+			key += BinarySuffix
+		}
+		buf.WriteString(key + "=" + secret + "\n")
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,31 @@
+// Package autoload decrypts .env.ace in the working directory into the
+// environment of the process when imported:
+//
+//	import _ "github.com/middle-management/ace/autoload"
+//
+// Variables which are already set are not overridden. A missing env file is
+// ignored, any other error, such as a missing identity, is logged.
+package autoload
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/middle-management/ace/acefile"
+)
+
+func init() {
+	if err := load(); err != nil {
+		log.Printf("ace: %v", err)
+	}
+}
+
+// load loads DefaultFile if it exists. A missing identity is an error, the
+// program would otherwise run without its secrets.
+func load() error {
+	if _, err := os.Stat(acefile.DefaultFile); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return acefile.Load()
+}
@@ -0,0 +1,25 @@
+package autoload
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/middle-management/ace/acefile"
+)
+
+func TestLoad(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if err := load(); err != nil {
+		t.Fatalf("expected a missing env file to be ignored, got %v", err)
+	}
+
+	if err := os.WriteFile(acefile.DefaultFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := load(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected an error for the missing identity, got %v", err)
+	}
+}
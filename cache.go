@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"github.com/middle-management/ace/acefile"
+)
+
+// keyCache is an acefile.KeyCache kept in a file in $XDG_RUNTIME_DIR which is
+// encrypted to the X25519 identity of the user, so repeated invocations only
+// need to decrypt the headers of new blocks.
+type keyCache struct {
+	path     string
+	identity *age.X25519Identity
+
+	mu      sync.Mutex
+	keys    map[[sha256.Size]byte][]byte
+	changed bool
+}
+
+// withKeyCache wraps identities in an identity which caches the keys of the
+// headers it decrypts. The cache must be saved once the env files are read.
+// If there is no X25519 identity to encrypt the cache to, or no runtime dir
+// to keep it in, a warning is logged and the identities are used as is.
+func withKeyCache(identities []age.Identity) ([]age.Identity, *keyCache) {
+	if len(identities) == 0 {
+		return identities, nil
+	}
+	var identity *age.X25519Identity
+	for _, id := range identities {
+		if x, ok := id.(*age.X25519Identity); ok {
+			identity = x
+			break
+		}
+	}
+	if identity == nil {
+		slog.Warn("cache disabled, it requires an X25519 identity")
+		return identities, nil
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		slog.Warn("cache disabled, it requires $XDG_RUNTIME_DIR")
+		return identities, nil
+	}
+
+	// one cache per identity, as the cache can only be read by it
+	sum := sha256.Sum256([]byte(identity.Recipient().String()))
+	cache := &keyCache{
+		path:     filepath.Join(dir, "ace", "keys-"+hex.EncodeToString(sum[:8])+".age"),
+		identity: identity,
+		keys:     map[[sha256.Size]byte][]byte{},
+	}
+	if err := cache.load(); err != nil {
+		// a cache is never worth failing for, start over
+		slog.Warn("ignoring invalid cache", "path", cache.path, "error", err)
+		cache.keys = map[[sha256.Size]byte][]byte{}
+	}
+	return []age.Identity{acefile.NewCachingIdentity(cache, identities...)}, cache
+}
+
+func (c *keyCache) Get(hash [sha256.Size]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[hash]
+	return key, ok
+}
+
+func (c *keyCache) Put(hash [sha256.Size]byte, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[hash] = key
+	c.changed = true
+}
+
+// load reads the cache file, a missing file is an empty cache. Each line holds
+// the hex encoded hash of a header and the base64 encoded key.
+func (c *keyCache) load() error {
+	f, err := os.Open(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := age.Decrypt(f, c.identity)
+	if err != nil {
+		return err
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		h, k, ok := strings.Cut(s.Text(), " ")
+		var hash [sha256.Size]byte
+		if n, err := hex.Decode(hash[:], []byte(h)); err != nil || n != len(hash) || !ok {
+			return fmt.Errorf("invalid line %q", s.Text())
+		}
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return err
+		}
+		c.keys[hash] = key
+	}
+	return s.Err()
+}
+
+// save writes the cache file if any keys were added. The file is replaced
+// atomically so concurrent invocations never read a partial cache.
+func (c *keyCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.changed {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, c.identity.Recipient())
+	if err != nil {
+		return err
+	}
+	for hash, key := range c.keys {
+		_, err := fmt.Fprintf(w, "%s %s\n", hex.EncodeToString(hash[:]), base64.StdEncoding.EncodeToString(key))
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(tmp, buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.changed = false
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Show *ConfigShow `arg:"subcommand:show" help:"Print the settings after applying the config file and profile"`
+
+	config      *configFile
+	profileName string
+	profile     Profile
+}
+
+type ConfigShow struct{}
+
+// Run prints the resolved settings, `show` is the default subcommand.
+func (cmd *Config) Run() error {
+	path := cmd.config.Path
+	if path == "" {
+		path = "(none)"
+	}
+	_, err := fmt.Fprintf(output, "# config: %s\n", path)
+	if err != nil {
+		return err
+	}
+	if cmd.profileName != "" {
+		_, err = fmt.Fprintf(output, "# profile: %s\n", cmd.profileName)
+		if err != nil {
+			return err
+		}
+	}
+	return toml.NewEncoder(output).Encode(cmd.profile.withDefaults())
+}
+
+// CONFIG_FILES are the names of the project config file, in order of
+// preference. The first one found walking up from the working directory is
+// used.
+var CONFIG_FILES = []string{".ace.toml", ".ace.yaml", ".ace.yml"}
+
+// Profile is a named environment with its own env files, recipients and
+// identities. Relative paths are relative to the config file.
+type Profile struct {
+	EnvFiles       []string `toml:"env-files" yaml:"env-files"`
+	RecipientFiles []string `toml:"recipient-files" yaml:"recipient-files"`
+	Identities     []string `toml:"identities" yaml:"identities"`
+	OnMissing      string   `toml:"on-missing" yaml:"on-missing"`
+	// Schema declares the expected variables, see VarSchema.
+	Schema map[string]VarSchema `toml:"schema,omitempty" yaml:"schema,omitempty"`
+}
+
+// withDefaults fills in the defaults used by the commands when neither a flag
+// nor the config file sets a value.
+func (p Profile) withDefaults() Profile {
+	if len(p.EnvFiles) == 0 {
+		p.EnvFiles = []string{"./.env.ace"}
+	}
+	if len(p.RecipientFiles) == 0 {
+		p.RecipientFiles = []string{"./recipients.txt"}
+	}
+	if len(p.Identities) == 0 {
+		p.Identities = []string{"$XDG_CONFIG_HOME/ace/identity"}
+	}
+	if p.OnMissing == "" {
+		p.OnMissing = "error"
+	}
+	return p
+}
+
+// configFile is the project config. The top level settings apply when no
+// profile is selected.
+type configFile struct {
+	Path     string `toml:"-" yaml:"-"`
+	Profile  `yaml:",inline"`
+	Profiles map[string]Profile `toml:"profiles" yaml:"profiles"`
+}
+
+// findConfig walks up from dir and loads the first of CONFIG_FILES it finds.
+// If there is none an empty config is returned.
+func findConfig(dir string) (*configFile, error) {
+	for {
+		cfg, err := loadConfig(dir)
+		if err != nil || cfg.Path != "" {
+			return cfg, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return cfg, nil
+		}
+		dir = parent
+	}
+}
+
+// loadConfig reads the first of CONFIG_FILES in dir. A missing file results in
+// an empty config.
+func loadConfig(dir string) (*configFile, error) {
+	cfg := &configFile{}
+	for _, name := range CONFIG_FILES {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if filepath.Ext(name) == ".toml" {
+			err = toml.Unmarshal(data, cfg)
+		} else {
+			err = yaml.Unmarshal(data, cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		cfg.Path = path
+		break
+	}
+	return cfg, nil
+}
+
+// profileNames returns the names of all profiles sorted alphabetically.
+func (c *configFile) profileNames() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profile looks up the profile called name. Fields which are not set in the
+// profile follow the naming convention `.env.NAME.ace` and
+// `recipients.NAME.txt`. Identities and on-missing fall back to the top level
+// settings, and then to `$XDG_CONFIG_HOME/ace/NAME.identity`. The schema is
+// merged with the top level schema.
+//
+// An empty name returns the top level settings. If a config file was found
+// these default to `.env.ace` and `recipients.txt` next to it, so that ace can
+// be used from any subdirectory of the project.
+func (c *configFile) profile(name string) (Profile, error) {
+	top := c.Profile
+	if c.Path != "" {
+		if len(top.EnvFiles) == 0 {
+			top.EnvFiles = []string{".env.ace"}
+		}
+		if len(top.RecipientFiles) == 0 {
+			top.RecipientFiles = []string{"recipients.txt"}
+		}
+	}
+
+	p := top
+	if name != "" {
+		var ok bool
+		p, ok = c.Profiles[name]
+		if !ok {
+			if c.Path == "" {
+				return Profile{}, fmt.Errorf("unknown profile %q: no %s found", name, strings.Join(CONFIG_FILES, " or "))
+			}
+			return Profile{}, fmt.Errorf("unknown profile %q: must be one of %s", name, strings.Join(c.profileNames(), ", "))
+		}
+
+		if len(p.EnvFiles) == 0 {
+			p.EnvFiles = []string{".env." + name + ".ace"}
+		}
+		if len(p.RecipientFiles) == 0 {
+			p.RecipientFiles = []string{"recipients." + name + ".txt"}
+		}
+		if len(p.Identities) == 0 {
+			p.Identities = top.Identities
+		}
+		if len(p.Identities) == 0 {
+			p.Identities = []string{"$XDG_CONFIG_HOME/ace/" + name + ".identity"}
+		}
+		if p.OnMissing == "" {
+			p.OnMissing = top.OnMissing
+		}
+		// the variables of the profile extend and override the top level ones
+		if len(top.Schema) > 0 {
+			schema := maps.Clone(top.Schema)
+			maps.Copy(schema, p.Schema)
+			p.Schema = schema
+		}
+	}
+
+	if c.Path != "" {
+		dir := filepath.Dir(c.Path)
+		p.EnvFiles = resolvePaths(dir, p.EnvFiles)
+		p.RecipientFiles = resolvePaths(dir, p.RecipientFiles)
+		p.Identities = resolvePaths(dir, p.Identities)
+	}
+	return p, nil
+}
+
+// resolvePaths makes relative paths relative to dir. Paths starting with an
+// environment variable are expanded later and left as is.
+func resolvePaths(dir string, paths []string) []string {
+	var resolved []string
+	for _, p := range paths {
+		if !filepath.IsAbs(p) && !strings.HasPrefix(p, "$") {
+			p = filepath.Join(dir, p)
+		}
+		resolved = append(resolved, p)
+	}
+	return resolved
+}
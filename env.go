@@ -1,87 +1,421 @@
 package main
 
 import (
-	"errors"
+	"cmp"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
 	"os/signal"
-	"syscall"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/middle-management/ace/internal/proc"
 )
 
 type Env struct {
-	OnMissing  string   `arg:"--on-missing" default:"error" help:"How to handle when env-file or identity is missing, can be 'ignore', 'warn' or 'error'"`
-	EnvFile    string   `arg:"--env-file,-e" default:"./.env.ace"`
-	Identities []string `arg:"--identity,-i,separate" help:"Decrypt using the specified IDENTITY. Can be repeated. Defaults to $XDG_CONFIG_HOME/ace/identity"`
-	Command    []string `arg:"positional,required"`
+	OnMissing    string        `arg:"--on-missing" help:"How to handle when env-file or identity is missing, can be 'ignore', 'warn' or 'error'. Defaults to 'error'"`
+	EnvFiles     []string      `arg:"--env-file,-e,separate" help:"Read variables from ENV-FILE. Can be repeated, later files override earlier ones. Suffix with :ignore, :warn or :error to override --on-missing for a file. Defaults to ./.env.ace"`
+	Identities   []string      `arg:"--identity,-i,separate" help:"Decrypt using the specified IDENTITY. Can be repeated. Defaults to $XDG_CONFIG_HOME/ace/identity"`
+	Expand       bool          `arg:"--expand" help:"Resolve ${NAME}, ${NAME:-default} and ${NAME:?error} references between values"`
+	ExpandEnv    bool          `arg:"--expand-env" help:"Like --expand but also resolve references against the parent environment"`
+	Secrets      bool          `arg:"--secrets" help:"Write each variable to a file and pass KEY_FILE with its path instead of KEY. The files are removed when the command exits"`
+	SecretsDir   string        `arg:"--secrets-dir" help:"Directory to create for --secrets. Defaults to a new directory in $XDG_RUNTIME_DIR"`
+	Strict       bool          `arg:"--strict" help:"Refuse to run the command if variables are missing or invalid according to the schema in the project config"`
+	Clean        bool          `arg:"--clean" help:"Run the command with only PATH, HOME and the variables of --keep from the parent environment"`
+	Keep         []string      `arg:"--keep,separate" help:"Pass the variable NAME of the parent environment with --clean. Can be repeated"`
+	Only         []string      `arg:"--only,separate" help:"Only pass the comma separated KEYS. Can be repeated"`
+	Exclude      []string      `arg:"--exclude,separate" help:"Do not pass the keys matching the glob PATTERN, such as 'AWS_*'. Can be repeated"`
+	Prefix       string        `arg:"--prefix" help:"Only pass the keys starting with PREFIX"`
+	StripPrefix  bool          `arg:"--strip-prefix" help:"Remove the --prefix from the keys"`
+	Rename       []string      `arg:"--rename,separate" help:"Pass the key OLD as NEW, given as OLD=NEW. Can be repeated"`
+	Override     bool          `arg:"--override" help:"Decrypted values override variables of the parent environment with the same name. This is the default"`
+	NoOverride   bool          `arg:"--no-override" help:"Variables of the parent environment override decrypted values with the same name"`
+	Exec         bool          `arg:"--exec" help:"Replace ace with the command instead of running it as a child process. Not supported on windows"`
+	Init         bool          `arg:"--init" help:"Reap adopted zombie processes like an init process. Enabled when running as PID 1"`
+	Watch        bool          `arg:"--watch" help:"Watch the env files and identities and restart the command when the variables change"`
+	StopSignal   string        `arg:"--stop-signal" help:"Signal to stop the command with before restarting it for --watch. Defaults to TERM"`
+	StopTimeout  time.Duration `arg:"--stop-timeout" help:"How long to wait for the command to stop before killing it. Defaults to 10s"`
+	Redact       bool          `arg:"--redact" help:"Replace the values in the output of the command by ***KEY***, also when base64 or URL encoded. Values shorter than 4 characters are not redacted"`
+	ReloadSignal string        `arg:"--reload-signal" help:"Send SIGNAL, such as HUP, to the command instead of restarting it for --watch. The files of --secrets or --binary=file are updated before, requires either"`
+	Cache        bool          `arg:"--cache,env:ACE_CACHE" help:"Cache the decrypted block keys in $XDG_RUNTIME_DIR, encrypted to the identity, so only new blocks need to be decrypted"`
+	Binary       string        `arg:"--binary" help:"How to pass binary values, can be 'base64' or 'file' to pass KEY_FILE like --secrets. Defaults to 'base64'"`
+	Command      []string      `arg:"positional,required"`
+
+	profile Profile
 }
 
 func (cmd *Env) Run() error {
 	if len(cmd.Command) == 0 {
 		return fmt.Errorf("missing command to run")
 	}
-	src, err := os.Open(cmd.EnvFile)
+	switch cmd.Binary {
+	case "", "base64", "file":
+	default:
+		return fmt.Errorf("invalid --binary %q, must be 'base64' or 'file'", cmd.Binary)
+	}
+	if cmd.Exec && (cmd.Secrets || cmd.SecretsDir != "" || cmd.Binary == "file") {
+		// nothing would be left to remove the files once the command exits
+		return fmt.Errorf("--exec can not be combined with --secrets, --secrets-dir or --binary=file")
+	}
+	if cmd.Exec && (cmd.Watch || cmd.Redact || cmd.Init) {
+		// there is no process left to watch, filter the output or reap
+		return fmt.Errorf("--exec can not be combined with --watch, --redact or --init")
+	}
+	if cmd.Override && cmd.NoOverride {
+		return fmt.Errorf("--override and --no-override can not be combined")
+	}
+	stopSignal, err := proc.ParseSignal(cmp.Or(cmd.StopSignal, "TERM"))
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			switch cmd.OnMissing {
-			case "ignore":
-				// silence
-			case "warn", "warning":
-				slog.Warn("env-file not found")
+		return fmt.Errorf("invalid --stop-signal: %w", err)
+	}
+	var reloadSignal os.Signal
+	if cmd.ReloadSignal != "" {
+		reloadSignal, err = proc.ParseSignal(cmd.ReloadSignal)
+		if err != nil {
+			return fmt.Errorf("invalid --reload-signal: %w", err)
+		}
+		if !cmd.Secrets && cmd.SecretsDir == "" && cmd.Binary != "file" {
+			// the environment of a running command can not be changed, only
+			// the files can
+			return fmt.Errorf("--reload-signal requires --secrets, --secrets-dir or --binary=file")
+		}
+	}
+	filter, err := newVarFilter(cmd.Only, cmd.Exclude, cmd.Prefix, cmd.StripPrefix, cmd.Rename)
+	if err != nil {
+		return err
+	}
+
+	// stat before reading so a change while reading is not missed
+	watched := cmd.watchedFiles()
+	stamps := statFiles(watched)
+	vars, binaryVars, err := cmd.load(filter)
+	if err != nil {
+		return err
+	}
+
+	secrets := &secretsDir{dir: cmd.SecretsDir}
+	defer secrets.remove()
+	env, err := cmd.environ(vars, binaryVars, secrets)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Exec {
+		path, err := exec.LookPath(cmd.Command[0])
+		if err != nil {
+			return err
+		}
+		return proc.Exec(path, cmd.Command, env)
+	}
+
+	// as PID 1 orphaned processes are adopted by ace and must be reaped
+	reap := cmd.Init || os.Getpid() == 1
+	if reap && os.Getpid() != 1 {
+		if err := proc.SetSubreaper(); err != nil {
+			slog.Warn("unable to adopt orphaned processes", "error", err)
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, proc.Signals()...)
+	defer signal.Stop(sigChan)
+
+	var redact *redactor
+	if cmd.Redact {
+		redact = newRedactor(slices.Concat(vars, binaryVars))
+	}
+
+	exited := make(chan error, 1)
+	start := func(env []string) (*exec.Cmd, error) {
+		c := exec.Command(cmd.Command[0], cmd.Command[1:]...)
+		c.Env = env
+		c.Stdin = os.Stdin
+		c.Stdout = output
+		c.Stderr = os.Stderr
+		proc.SetupSysProcAttr(c, reap)
+
+		var copied []<-chan struct{}
+		for _, w := range []*io.Writer{&c.Stdout, &c.Stderr} {
+			// WaitReaping does not wait for exec.Cmd to copy output which is
+			// not a file, so it is copied here as well
+			if _, ok := (*w).(*os.File); redact == nil && (ok || !reap) {
+				continue
+			}
+			pw, done, err := redact.pipe(*w)
+			if err != nil {
+				return nil, err
+			}
+			defer pw.Close()
+			*w = pw
+			copied = append(copied, done)
+		}
+
+		if err := c.Start(); err != nil {
+			return nil, err
+		}
+		go func() {
+			var err error
+			if reap {
+				err = proc.WaitReaping(c)
+			} else {
+				err = proc.Wait(c)
+			}
+			for _, done := range copied {
+				<-done
+			}
+			exited <- err
+		}()
+		return c, nil
+	}
+	c, err := start(env)
+	if err != nil {
+		return err
+	}
+
+	var tick <-chan time.Time
+	if cmd.Watch {
+		ticker := time.NewTicker(WATCH_INTERVAL)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	loaded := slices.Concat(vars, binaryVars)
+	redacted := loaded
+	for {
+		select {
+		case sig := <-sigChan:
+			if !proc.TerminalSignal(c, sig) {
+				proc.ForwardSignal(c, sig)
+			}
+
+		case err := <-exited:
+			return err
+
+		case <-tick:
+			next := statFiles(watched)
+			if maps.Equal(next, stamps) {
+				continue
+			}
+			stamps = next
+			vars, binaryVars, err := cmd.load(filter)
+			if err != nil {
+				slog.Warn("unable to reload the variables, keeping the command running", "error", err)
+				continue
+			}
+			if slices.Equal(slices.Concat(vars, binaryVars), loaded) {
+				continue
+			}
+			loaded = slices.Concat(vars, binaryVars)
+			if redact != nil {
+				// the running command still knows the old values
+				redacted = unionVars(loaded, redacted)
+				redact.setValues(redacted)
+			}
+			env, err := cmd.environ(vars, binaryVars, secrets)
+			if err != nil {
+				slog.Warn("unable to reload the variables, keeping the command running", "error", err)
+				continue
+			}
+
+			if reloadSignal != nil {
+				slog.Info("variables changed, signaling the command", "signal", reloadSignal)
+				proc.ForwardSignal(c, reloadSignal)
+				continue
+			}
+			// the command may have exited while the variables were loaded,
+			// its status is returned instead of restarting it
+			select {
+			case err := <-exited:
+				return err
 			default:
+			}
+			slog.Info("variables changed, restarting the command")
+			cmd.stop(c, stopSignal, exited, sigChan)
+			if redact != nil {
+				redacted = loaded
+				redact.setValues(redacted)
+			}
+			proc.RestoreForeground(c)
+			c, err = start(env)
+			if err != nil {
 				return err
 			}
-		} else {
-			return err
 		}
-	} else {
-		defer src.Close()
 	}
+}
 
-	identities, err := readIdentities(cmd.Identities, cmd.OnMissing)
+// load reads the env files and returns the variables passed to the command
+// as KEY=VALUE pairs, and the binary values of --binary=file separately.
+func (cmd *Env) load(filter *varFilter) (vars, binaryVars []string, err error) {
+	onMissing := cmd.OnMissing
+	if onMissing == "" {
+		onMissing = cmd.profile.OnMissing
+	}
+
+	envFiles := cmd.EnvFiles
+	if len(envFiles) == 0 {
+		envFiles = cmd.profile.EnvFiles
+	}
+	files, err := openEnvFiles(envFiles, onMissing)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	defer closeEnvFiles(files)
 
-	vars, err := readEnvFile(src, identities, false)
+	idents := cmd.Identities
+	if len(idents) == 0 {
+		idents = cmd.profile.Identities
+	}
+	identities, err := readIdentities(idents, onMissing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cache *keyCache
+	if cmd.Cache {
+		identities, cache = withKeyCache(identities)
+	}
+
+	envVars, err := readEnvFiles(files, identities, false)
+	if err := cache.save(); err != nil {
+		slog.Warn("unable to save cache", "error", err)
+	}
 	if err != nil {
 		if err.Error() == "no identities specified" {
-			switch cmd.OnMissing {
+			switch onMissing {
 			case "ignore":
 				// silence
 			case "warn", "warning":
 				slog.Warn(err.Error())
 			default:
-				return err
+				return nil, nil, err
 			}
 		} else {
-			return err
+			return nil, nil, err
 		}
 	}
 
-	c := exec.Command(cmd.Command[0], cmd.Command[1:]...)
-	c.Env = append(os.Environ(), vars...)
-	c.Stdin = os.Stdin
-	c.Stderr = os.Stderr
-	c.Stdout = output
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-	defer func() {
-		signal.Stop(sigChan)
-		close(sigChan)
-	}()
-
-	go func() {
-		for sig := range sigChan {
-			if c.Process != nil {
-				proc.ForwardSignal(c, sig)
+	for _, v := range envVars {
+		if v.Binary {
+			if cmd.Binary == "file" {
+				binaryVars = append(binaryVars, v.String())
+				continue
 			}
+			v.Value = base64.StdEncoding.EncodeToString([]byte(v.Value))
+		}
+		vars = append(vars, v.String())
+	}
+
+	if cmd.Expand || cmd.ExpandEnv {
+		var lookupEnv func(string) (string, bool)
+		if cmd.ExpandEnv {
+			lookupEnv = os.LookupEnv
+		}
+		vars, err = expandVars(vars, lookupEnv)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if cmd.Strict {
+		violations := checkSchema(cmd.profile.Schema, slices.Concat(vars, binaryVars))
+		if len(violations) > 0 {
+			return nil, nil, fmt.Errorf("not running %s, %d schema violations: %s", cmd.Command[0], len(violations), strings.Join(violations, "; "))
+		}
+	}
+
+	// filter once references are resolved and the schema is checked, so
+	// that references to variables which are left out still resolve
+	return filter.apply(vars), filter.apply(binaryVars), nil
+}
+
+// environ returns the environment of the command with vars, writing the files
+// of --secrets and --binary=file to secrets.
+func (cmd *Env) environ(vars, binaryVars []string, secrets *secretsDir) ([]string, error) {
+	if cmd.Secrets || cmd.SecretsDir != "" {
+		fileVars, err := secrets.write(slices.Concat(vars, binaryVars))
+		if err != nil {
+			return nil, err
+		}
+		vars = fileVars
+	} else if len(binaryVars) > 0 {
+		fileVars, err := secrets.write(binaryVars)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		vars = slices.Concat(vars, fileVars)
+	}
+
+	env := os.Environ()
+	if cmd.Clean {
+		env = cleanEnviron(cmd.Keep)
+	}
+	env, shadowed := mergeEnviron(env, vars, !cmd.NoOverride)
+	if len(shadowed) > 0 {
+		if cmd.NoOverride {
+			slog.Warn("decrypted values shadowed by the environment", "keys", strings.Join(shadowed, ","))
+		} else {
+			slog.Warn("environment overridden by decrypted values", "keys", strings.Join(shadowed, ","))
+		}
+	}
+	return env, nil
+}
 
-	return c.Run()
+// watchedFiles returns the paths of the env files and identities for --watch.
+func (cmd *Env) watchedFiles() []string {
+	if !cmd.Watch {
+		return nil
+	}
+	envFiles := cmd.EnvFiles
+	if len(envFiles) == 0 {
+		envFiles = cmd.profile.EnvFiles
+	}
+	if len(envFiles) == 0 {
+		envFiles = []string{"./.env.ace"}
+	}
+	idents := cmd.Identities
+	if len(idents) == 0 {
+		idents = cmd.profile.Identities
+	}
+	if len(idents) == 0 {
+		idents = []string{"$XDG_CONFIG_HOME/ace/identity"}
+	}
+
+	var paths []string
+	for _, p := range envFiles {
+		path, _ := splitOnMissing(p, "")
+		paths = append(paths, path)
+	}
+	if setConfigHome() == nil {
+		for _, id := range idents {
+			paths = append(paths, os.ExpandEnv(id))
+		}
+	}
+	return paths
+}
+
+// stop sends sig to the command and kills it if it did not exit within
+// --stop-timeout. Signals received in the meantime are forwarded.
+func (cmd *Env) stop(c *exec.Cmd, sig os.Signal, exited <-chan error, sigChan <-chan os.Signal) {
+	proc.ForwardSignal(c, sig)
+	timeout := cmp.Or(cmd.StopTimeout, 10*time.Second)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case s := <-sigChan:
+			if !proc.TerminalSignal(c, s) {
+				proc.ForwardSignal(c, s)
+			}
+		case <-timer.C:
+			slog.Warn("the command did not stop in time, killing it", "timeout", timeout)
+			proc.ForwardSignal(c, os.Kill)
+		}
+	}
 }
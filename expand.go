@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// expandVars resolves `${NAME}`, `${NAME:-default}` and `${NAME:?error}`
+// references in the values of vars. References are resolved against the other
+// values in vars and, when lookupEnv is not nil, against the parent
+// environment. Values in vars take precedence over the environment.
+func expandVars(vars []string, lookupEnv func(string) (string, bool)) ([]string, error) {
+	e := &expander{
+		vals:      map[string]string{},
+		lookupEnv: lookupEnv,
+		resolved:  map[string]string{},
+		missing:   map[string][]string{},
+	}
+	var keys []string
+	for _, kv := range vars {
+		k, v, _ := strings.Cut(kv, "=")
+		if _, exists := e.vals[k]; !exists {
+			keys = append(keys, k)
+		}
+		e.vals[k] = v
+	}
+
+	var expanded []string
+	for _, k := range keys {
+		v, err := e.resolve(k)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, k+"="+v)
+	}
+
+	if len(e.missing) > 0 {
+		var refs []string
+		for name, from := range e.missing {
+			refs = append(refs, fmt.Sprintf("%s (in %s)", name, strings.Join(from, ", ")))
+		}
+		sort.Strings(refs)
+		return nil, fmt.Errorf("unresolved references: %s", strings.Join(refs, "; "))
+	}
+
+	return expanded, nil
+}
+
+type expander struct {
+	vals      map[string]string
+	lookupEnv func(string) (string, bool)
+	resolved  map[string]string
+	stack     []string
+	missing   map[string][]string
+}
+
+func (e *expander) resolve(key string) (string, error) {
+	if v, ok := e.resolved[key]; ok {
+		return v, nil
+	}
+	for i, k := range e.stack {
+		if k == key {
+			cycle := append(append([]string{}, e.stack[i:]...), key)
+			return "", fmt.Errorf("reference cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	e.stack = append(e.stack, key)
+	v, err := e.expand(key, e.vals[key])
+	e.stack = e.stack[:len(e.stack)-1]
+	if err != nil {
+		return "", err
+	}
+	e.resolved[key] = v
+	return v, nil
+}
+
+func (e *expander) lookup(name string) (string, bool, error) {
+	if _, ok := e.vals[name]; ok {
+		v, err := e.resolve(name)
+		return v, true, err
+	}
+	if e.lookupEnv != nil {
+		v, ok := e.lookupEnv(name)
+		return v, ok, nil
+	}
+	return "", false, nil
+}
+
+func (e *expander) expand(key, value string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 >= len(value) || value[i+1] != '{' {
+			out.WriteByte(value[i])
+			continue
+		}
+
+		// find the matching closing brace, allowing nested references in
+		// default values
+		depth := 0
+		end := -1
+		for j := i + 2; j < len(value) && end < 0; j++ {
+			switch {
+			case value[j] == '$' && j+1 < len(value) && value[j+1] == '{':
+				depth++
+				j++
+			case value[j] == '}' && depth > 0:
+				depth--
+			case value[j] == '}':
+				end = j
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("%s: unclosed reference %q", key, value[i:])
+		}
+
+		v, err := e.substitute(key, value[i+2:end])
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(v)
+		i = end
+	}
+	return out.String(), nil
+}
+
+func (e *expander) substitute(key, ref string) (string, error) {
+	n := 0
+	for n < len(ref) && (ref[n] == '_' || isAlpha(ref[n]) || (n > 0 && isDigit(ref[n]))) {
+		n++
+	}
+	name, op := ref[:n], ref[n:]
+	if name == "" {
+		return "", fmt.Errorf("%s: bad substitution ${%s}", key, ref)
+	}
+
+	v, ok, err := e.lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case op == "":
+		if !ok {
+			e.missing[name] = appendUnique(e.missing[name], key)
+		}
+		return v, nil
+	case strings.HasPrefix(op, ":-"):
+		if v == "" {
+			return e.expand(key, op[2:])
+		}
+		return v, nil
+	case strings.HasPrefix(op, ":?"):
+		if v == "" {
+			msg := op[2:]
+			if msg == "" {
+				msg = "parameter null or not set"
+			}
+			return "", fmt.Errorf("%s: %s: %s", key, name, msg)
+		}
+		return v, nil
+	default:
+		return "", fmt.Errorf("%s: bad substitution ${%s}", key, ref)
+	}
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, l := range list {
+		if l == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
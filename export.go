@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type Export struct {
+	CI *ExportCI `arg:"subcommand:ci" help:"Pass the variables to the following steps of a CI job. With github they are masked in the job log, with gitlab they are stored unmasked in the dotenv report artifact"`
+
+	profile Profile
+}
+
+type ExportCI struct {
+	Provider   string   `arg:"--provider,required" help:"The CI system, can be 'github' or 'gitlab'"`
+	EnvFiles   []string `arg:"--env-file,-e,separate" help:"Read variables from ENV-FILE. Can be repeated, later files override earlier ones. Defaults to ./.env.ace or the env files of the profile"`
+	Identities []string `arg:"--identity,-i,separate" help:"Decrypt using the specified IDENTITY. Can be repeated. Defaults to $XDG_CONFIG_HOME/ace/identity"`
+	Output     string   `arg:"--output,-o" help:"Append the variables to OUTPUT. Defaults to $GITHUB_ENV for github and ace.env for gitlab"`
+	Keys       []string `arg:"positional" help:"Only export KEYS. Defaults to all variables"`
+}
+
+func (cmd *Export) Run() error {
+	if cmd.CI == nil {
+		return fmt.Errorf("missing subcommand, such as ci")
+	}
+	return cmd.CI.run(cmd.profile)
+}
+
+func (cmd *ExportCI) run(profile Profile) error {
+	var write func(w io.Writer, vars []envVar) error
+	path := cmd.Output
+	switch cmd.Provider {
+	case "github":
+		write = writeGitHubEnv
+		if path == "" {
+			path = os.Getenv("GITHUB_ENV")
+		}
+		if path == "" {
+			return fmt.Errorf("GITHUB_ENV is not set, run in a GitHub Actions job or use --output")
+		}
+	case "gitlab":
+		write = writeGitLabDotenv
+		if path == "" {
+			path = "ace.env"
+		}
+		slog.Warn("gitlab does not mask the variables of a dotenv report, the values are stored unmasked in the job artifact", "output", path)
+	default:
+		return fmt.Errorf("invalid --provider %q, must be 'github' or 'gitlab'", cmd.Provider)
+	}
+
+	onMissing := profile.OnMissing
+	if onMissing == "" {
+		onMissing = "error"
+	}
+	envFiles := cmd.EnvFiles
+	if len(envFiles) == 0 {
+		envFiles = profile.EnvFiles
+	}
+	files, err := openEnvFiles(envFiles, onMissing)
+	if err != nil {
+		return err
+	}
+	defer closeEnvFiles(files)
+
+	idents := cmd.Identities
+	if len(idents) == 0 {
+		idents = profile.Identities
+	}
+	identities, err := readIdentities(idents, onMissing)
+	if err != nil {
+		return err
+	}
+
+	var vars []envVar
+	if len(cmd.Keys) > 0 {
+		vars, err = lookupEnvFiles(files, identities, cmd.Keys, false)
+	} else {
+		vars, err = readEnvFiles(files, identities, false)
+	}
+	if err != nil {
+		return err
+	}
+	if len(vars) < len(cmd.Keys) {
+		for _, k := range cmd.Keys {
+			if !containsKey(vars, k) {
+				return fmt.Errorf("%s not found", k)
+			}
+		}
+	}
+	for i, v := range vars {
+		if v.Binary {
+			vars[i].Value = base64.StdEncoding.EncodeToString([]byte(v.Value))
+		}
+	}
+
+	// mask the values before they can show up in the log
+	if cmd.Provider == "github" {
+		for _, v := range vars {
+			for _, line := range strings.Split(v.Value, "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					fmt.Fprintf(output, "::add-mask::%s\n", escapeWorkflowData(line))
+				}
+			}
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := write(f, vars); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func containsKey(vars []envVar, key string) bool {
+	for _, v := range vars {
+		if v.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeWorkflowData escapes the data of a GitHub Actions workflow command.
+func escapeWorkflowData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// writeGitHubEnv writes vars in the format of $GITHUB_ENV. Multiline values
+// use the KEY<<DELIMITER syntax with a random delimiter.
+func writeGitHubEnv(w io.Writer, vars []envVar) error {
+	var b strings.Builder
+	for _, v := range vars {
+		if !strings.ContainsAny(v.Value, "\r\n") {
+			fmt.Fprintf(&b, "%s=%s\n", v.Key, v.Value)
+			continue
+		}
+		delimiter, err := heredocDelimiter(v.Value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s<<%s\n%s\n%s\n", v.Key, delimiter, v.Value, delimiter)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// heredocDelimiter returns a random delimiter which does not occur in value.
+func heredocDelimiter(value string) (string, error) {
+	for {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		delimiter := "ACE_EOF_" + hex.EncodeToString(b)
+		if !strings.Contains(value, delimiter) {
+			return delimiter, nil
+		}
+	}
+}
+
+// writeGitLabDotenv writes vars in the format of a GitLab dotenv report, which
+// does not support multiline values.
+func writeGitLabDotenv(w io.Writer, vars []envVar) error {
+	var b strings.Builder
+	for _, v := range vars {
+		if strings.ContainsAny(v.Value, "\r\n") {
+			return fmt.Errorf("%s: multiline values are not supported in gitlab dotenv reports", v.Key)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", v.Key, v.Value)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
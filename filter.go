@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// CLEAN_ENV are the variables of the parent environment passed to the command
+// with --clean.
+var CLEAN_ENV = []string{"PATH", "HOME"}
+
+// varFilter selects and renames the variables passed to the command.
+type varFilter struct {
+	only        []string
+	exclude     []string
+	prefix      string
+	stripPrefix bool
+	rename      map[string]string
+}
+
+// newVarFilter parses the filter flags. only holds comma separated keys,
+// exclude holds glob patterns and rename holds OLD=NEW pairs.
+func newVarFilter(only, exclude []string, prefix string, stripPrefix bool, rename []string) (*varFilter, error) {
+	f := &varFilter{exclude: exclude, prefix: prefix, stripPrefix: stripPrefix, rename: map[string]string{}}
+	for _, o := range only {
+		for _, k := range strings.Split(o, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				f.only = append(f.only, k)
+			}
+		}
+	}
+	for _, pattern := range exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --exclude %q: %w", pattern, err)
+		}
+	}
+	if stripPrefix && prefix == "" {
+		return nil, fmt.Errorf("--strip-prefix requires --prefix")
+	}
+	for _, r := range rename {
+		from, to, ok := strings.Cut(r, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid --rename %q, must be OLD=NEW", r)
+		}
+		f.rename[from] = to
+	}
+	return f, nil
+}
+
+// apply filters and renames vars, KEY=VALUE pairs, in the order --only,
+// --exclude, --prefix and --rename.
+func (f *varFilter) apply(vars []string) []string {
+	var filtered []string
+	for _, kv := range vars {
+		k, v, _ := strings.Cut(kv, "=")
+		if len(f.only) > 0 && !slices.Contains(f.only, k) {
+			continue
+		}
+		if slices.ContainsFunc(f.exclude, func(pattern string) bool {
+			match, _ := path.Match(pattern, k)
+			return match
+		}) {
+			continue
+		}
+		if f.prefix != "" {
+			if !strings.HasPrefix(k, f.prefix) {
+				continue
+			}
+			if f.stripPrefix {
+				k = strings.TrimPrefix(k, f.prefix)
+			}
+		}
+		if k == "" {
+			continue
+		}
+		if to, ok := f.rename[k]; ok {
+			k = to
+		}
+		filtered = append(filtered, k+"="+v)
+	}
+	return filtered
+}
+
+// cleanEnviron returns the variables of CLEAN_ENV and keep from the
+// environment of the current process.
+func cleanEnviron(keep []string) []string {
+	keys := slices.Clone(CLEAN_ENV)
+	for _, k := range keep {
+		keys = appendUnique(keys, k)
+	}
+	var env []string
+	for _, k := range keys {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+// mergeEnviron adds vars to the environment env, replacing variables which
+// are already set if override is set and leaving them as is otherwise. The
+// keys whose value was dropped are returned as shadowed.
+func mergeEnviron(env, vars []string, override bool) (merged []string, shadowed []string) {
+	merged = slices.Clone(env)
+	index := map[string]int{}
+	for i, kv := range merged {
+		k, _, _ := strings.Cut(kv, "=")
+		index[k] = i
+	}
+	for _, kv := range vars {
+		k, _, _ := strings.Cut(kv, "=")
+		i, exists := index[k]
+		switch {
+		case !exists:
+			index[k] = len(merged)
+			merged = append(merged, kv)
+		case merged[i] == kv:
+			// same value, nothing is shadowed
+		case override:
+			merged[i] = kv
+			shadowed = appendUnique(shadowed, k)
+		default:
+			shadowed = appendUnique(shadowed, k)
+		}
+	}
+	return merged, shadowed
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/middle-management/ace/acefile"
+	"github.com/middle-management/ace/internal/lock"
+)
+
+type Fsck struct {
+	EnvFiles []string `arg:"--env-file,-e,separate" help:"Check ENV-FILE. Can be repeated. Defaults to ./.env.ace or the env files of the profile"`
+	Repair   bool     `arg:"--repair" help:"Truncate each file after its last complete block, removing an interrupted write, and end the block with a blank line if it is missing"`
+
+	profile Profile
+}
+
+// Run checks the structure of the env files. It fails if any problems are
+// found which were not repaired.
+func (cmd *Fsck) Run() error {
+	envFiles := cmd.EnvFiles
+	if len(envFiles) == 0 {
+		envFiles = cmd.profile.EnvFiles
+	}
+	if len(envFiles) == 0 {
+		envFiles = []string{"./.env.ace"}
+	}
+
+	var problems int
+	for _, p := range envFiles {
+		path, onMissing := splitOnMissing(p, "error")
+		n, err := cmd.check(path)
+		if errors.Is(err, os.ErrNotExist) && onMissing != "error" {
+			continue
+		} else if err != nil {
+			return err
+		}
+		problems += n
+	}
+	if problems > 0 {
+		if cmd.Repair {
+			return fmt.Errorf("%d problems found which can not be repaired", problems)
+		}
+		return fmt.Errorf("%d problems found, use --repair to truncate after the last complete block", problems)
+	}
+	return nil
+}
+
+// check prints the problems of the file at path and repairs it if requested.
+// It returns the number of problems which remain.
+func (cmd *Fsck) check(path string) (int, error) {
+	flag := os.O_RDONLY
+	if cmd.Repair {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if cmd.Repair {
+		// keep concurrent runs of set from appending while truncating
+		if err := lock.Lock(f); err != nil {
+			return 0, fmt.Errorf("unable to lock %s: %w", path, err)
+		}
+		defer lock.Unlock(f)
+	}
+
+	report, err := acefile.Check(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var remaining int
+	for _, p := range report.Problems {
+		fmt.Fprintf(output, "%s:%d: %s\n", path, p.Line, p.Message)
+		if !cmd.Repair || !p.Repairable {
+			remaining++
+		}
+	}
+
+	if !cmd.Repair {
+		return remaining, nil
+	}
+	if report.Complete < report.Size {
+		if err := f.Truncate(report.Complete); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(output, "%s: truncated after line %d, removed %d bytes\n", path, report.Lines, report.Size-report.Complete)
+	}
+	if report.Terminator != "" {
+		if _, err := f.WriteAt([]byte(report.Terminator), report.Complete); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(output, "%s: ended the block at line %d with a blank line\n", path, report.Lines)
+	}
+	return remaining, nil
+}
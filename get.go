@@ -1,49 +1,151 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"strings"
+
+	"github.com/middle-management/ace/acefile"
 )
 
 type Get struct {
-	EnvFile    string   `arg:"--env-file,-e" default:"./.env.ace"`
+	EnvFiles   []string `arg:"--env-file,-e,separate" help:"Read variables from ENV-FILE. Can be repeated, later files override earlier ones. Suffix with :ignore or :warn to allow a file to be missing. Defaults to ./.env.ace"`
 	Identities []string `arg:"--identity,-i,separate" help:"Decrypt using the specified IDENTITY. Can be repeated. Defaults to $XDG_CONFIG_HOME/ace/identity"`
+	Expand     bool     `arg:"--expand" help:"Resolve ${NAME}, ${NAME:-default} and ${NAME:?error} references between values"`
+	ExpandEnv  bool     `arg:"--expand-env" help:"Like --expand but also resolve references against the parent environment"`
+	ShowSource bool     `arg:"--show-source" help:"Print the file, block and line each value was read from"`
+	Cache      bool     `arg:"--cache,env:ACE_CACHE" help:"Cache the decrypted block keys in $XDG_RUNTIME_DIR, encrypted to the identity, so only new blocks need to be decrypted"`
+	Raw        bool     `arg:"--raw" help:"Write the exact unquoted value or bytes of a single KEY without a trailing newline"`
 	Keys       []string `arg:"positional"`
+
+	profile Profile
 }
 
 func (cmd *Get) Run() error {
-	src, err := os.Open(cmd.EnvFile)
+	envFiles := cmd.EnvFiles
+	if len(envFiles) == 0 {
+		envFiles = cmd.profile.EnvFiles
+	}
+	onMissing := cmd.profile.OnMissing
+	if onMissing == "" {
+		onMissing = "error"
+	}
+	files, err := openEnvFiles(envFiles, onMissing)
 	if err != nil {
 		return err
 	}
-	defer src.Close()
+	defer closeEnvFiles(files)
 
-	identities, err := readIdentities(cmd.Identities, "error")
+	idents := cmd.Identities
+	if len(idents) == 0 {
+		idents = cmd.profile.Identities
+	}
+	identities, err := readIdentities(idents, onMissing)
 	if err != nil {
 		return err
 	}
 
-	vars, err := readEnvFile(src, identities, true)
+	if cmd.Raw && len(cmd.Keys) != 1 {
+		return fmt.Errorf("--raw requires exactly one KEY")
+	}
+
+	var cache *keyCache
+	if cmd.Cache {
+		identities, cache = withKeyCache(identities)
+	}
+
+	expand := cmd.Expand || cmd.ExpandEnv
+	var vars []envVar
+	if len(cmd.Keys) > 0 && !expand && !cmd.ShowSource {
+		// references and the position of values require reading all blocks
+		vars, err = lookupEnvFiles(files, identities, cmd.Keys, !cmd.Raw)
+	} else {
+		vars, err = readEnvFiles(files, identities, !expand && !cmd.Raw)
+	}
+	if err := cache.save(); err != nil {
+		slog.Warn("unable to save cache", "error", err)
+	}
 	if err != nil {
 		return err
 	}
 
-	for _, kv := range vars {
-		if len(cmd.Keys) > 0 {
-			var match bool
-			for _, k := range cmd.Keys {
-				if strings.HasPrefix(kv, k+"=") {
-					match = true
-					break
-				}
+	if expand {
+		var lookupEnv func(string) (string, bool)
+		if cmd.ExpandEnv {
+			lookupEnv = os.LookupEnv
+		}
+		// binary values can not be referenced
+		var text []string
+		var index []int
+		for i, v := range vars {
+			if !v.Binary {
+				text = append(text, v.String())
+				index = append(index, i)
+			}
+		}
+		expanded, err := expandVars(text, lookupEnv)
+		if err != nil {
+			return err
+		}
+		for i, kv := range expanded {
+			_, v, _ := strings.Cut(kv, "=")
+			if !cmd.Raw {
+				// quote the expanded values again so the output can be piped back to `ace set`
+				v = acefile.QuoteValue(v)
+			}
+			vars[index[i]].Value = v
+		}
+	}
+
+	if cmd.Raw {
+		for _, v := range vars {
+			if v.Key == cmd.Keys[0] {
+				_, err := io.WriteString(output, v.Value)
+				return err
 			}
-			if !match {
-				continue
+		}
+		return fmt.Errorf("%s not found", cmd.Keys[0])
+	}
+
+	if len(cmd.Keys) > 0 {
+		// print in the order of the keys whichever way they were read
+		byKey := map[string]envVar{}
+		for _, v := range vars {
+			byKey[v.Key] = v
+		}
+		vars = vars[:0]
+		for _, k := range cmd.Keys {
+			if v, ok := byKey[k]; ok {
+				vars = append(vars, v)
+				delete(byKey, k)
 			}
 		}
-		fmt.Fprintln(output, kv)
+	}
+
+	for _, v := range vars {
+		if cmd.ShowSource {
+			fmt.Fprintf(output, "# %s block %d line %d\n", v.File, v.Block, v.Line)
+		}
+		if v.Binary {
+			v.Value = BASE64_PREFIX + base64.StdEncoding.EncodeToString([]byte(v.Value))
+		} else {
+			v.Value = quoteAt(v.Value)
+		}
+		fmt.Fprintln(output, v)
 	}
 
 	return nil
 }
+
+// quoteAt quotes text values starting with @, such as those set before
+// `@path` was read as a file, so piping the output to `ace set` keeps them as
+// text.
+func quoteAt(value string) string {
+	if !strings.HasPrefix(value, "@") {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(value) + `"`
+}
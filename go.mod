@@ -4,12 +4,15 @@ go 1.25.1
 
 require (
 	filippo.io/age v1.3.1
+	github.com/BurntSushi/toml v1.5.0
 	github.com/alexflint/go-arg v1.6.1
 	golang.org/x/crypto v0.47.0
+	golang.org/x/sys v0.40.0
+	golang.org/x/term v0.39.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	filippo.io/hpke v0.4.0 // indirect
 	github.com/alexflint/go-scalar v1.2.0 // indirect
-	golang.org/x/sys v0.40.0 // indirect
 )
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestInitHelper runs ace env in a subprocess of TestInit, so that adopting
+// orphans and signals do not affect the test process.
+func TestInitHelper(t *testing.T) {
+	script := os.Getenv("ACE_TEST_INIT_SCRIPT")
+	if script == "" {
+		t.Skip("only run by TestInit")
+	}
+	// hide the file, so the output must be copied before ace exits
+	output = struct{ io.Writer }{os.Stdout}
+	cmd := &Env{EnvFiles: []string{os.Getenv("ACE_TEST_INIT_ENV_FILE")}, Identities: []string{"testdata/identity1"}, Init: true, Command: []string{"sh", "-c", script}}
+	err := cmd.Run()
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+func TestInit(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, ".env.ace")
+	{
+		cmd := &Set{EnvFile: envFile, RecipientFiles: []string{"testdata/recipients1.txt"}, EnvPairs: []string{"A=1"}}
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	helper := func(script string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInitHelper$")
+		cmd.Env = append(os.Environ(), "ACE_TEST_INIT_SCRIPT="+script, "ACE_TEST_INIT_ENV_FILE="+envFile, "PIDFILE="+filepath.Join(dir, "pid"))
+		return cmd
+	}
+
+	t.Run("reap", func(t *testing.T) {
+		// the grandchild is orphaned when its parent exits, and would be left
+		// a zombie if ace did not reap it
+		cmd := helper(`
+			sh -c 'sleep 0.1 & echo $! > "$PIDFILE"'
+			sleep 0.5
+			pid=$(cat "$PIDFILE")
+			if [ -e /proc/$pid ]; then
+				echo "not reaped: $(cut -d' ' -f3 /proc/$pid/stat)"
+			else
+				echo reaped $A
+			fi
+			exit 42
+		`)
+		out, err := cmd.CombinedOutput()
+		if cmd.ProcessState.ExitCode() != 42 {
+			t.Errorf("expected exit code 42, got %v", err)
+		}
+		if string(out) != "reaped 1\n" {
+			t.Errorf("unexpected output %q", out)
+		}
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		// exits like a shell, with 128 plus the signal number
+		cmd := helper(`echo killed; kill -TERM $$`)
+		out, _ := cmd.CombinedOutput()
+		if cmd.ProcessState.ExitCode() != 128+int(syscall.SIGTERM) {
+			t.Errorf("expected exit code %d, got %d", 128+int(syscall.SIGTERM), cmd.ProcessState.ExitCode())
+		}
+		if string(out) != "killed\n" {
+			t.Errorf("unexpected output %q", out)
+		}
+	})
+
+	for _, sig := range []syscall.Signal{syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH, syscall.SIGQUIT, syscall.SIGTERM} {
+		t.Run("forward "+sig.String(), func(t *testing.T) {
+			name := strings.TrimPrefix(unix.SignalName(sig), "SIG")
+			cmd := helper(`
+				trap 'echo got ` + name + `; exit 3' ` + name + `
+				echo ready
+				while :; do sleep 0.05; done
+			`)
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			r := bufio.NewReader(stdout)
+			line, err := r.ReadString('\n')
+			if err != nil || line != "ready\n" {
+				t.Fatalf("expected ready, got %q %v", line, err)
+			}
+			if err := cmd.Process.Signal(sig); err != nil {
+				t.Fatal(err)
+			}
+			rest, _ := io.ReadAll(r)
+			cmd.Wait()
+			if string(rest) != "got "+name+"\n" {
+				t.Errorf("unexpected output %q", rest)
+			}
+			if cmd.ProcessState.ExitCode() != 3 {
+				t.Errorf("expected exit code 3, got %d", cmd.ProcessState.ExitCode())
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+// Package lock takes advisory locks on files, so that processes appending to
+// the same file do not interleave their writes.
+package lock
+
+import "os"
+
+// Lock blocks until it holds an exclusive lock on f. The lock is released by
+// Unlock or when f is closed.
+func Lock(f *os.File) error {
+	return lock(f)
+}
+
+// Unlock releases the lock on f.
+func Unlock(f *os.File) error {
+	return unlock(f)
+}
@@ -0,0 +1,51 @@
+package lock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	a, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := Lock(a); err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan error)
+	go func() {
+		locked <- Lock(b)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected the second lock to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := Unlock(a); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second lock once the first is released")
+	}
+	if err := Unlock(b); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package lock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffset is the byte which is locked. Locks on windows are mandatory, so
+// it lies past any data of an env file, where the lock does not keep others
+// from reading or appending to the file, only from locking it.
+const lockOffset = 0xFFFFFFFF
+
+func lock(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{Offset: lockOffset})
+}
+
+func unlock(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{Offset: lockOffset})
+}
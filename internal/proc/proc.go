@@ -1,14 +1,100 @@
 package proc
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"syscall"
 )
 
-func SetupSysProcAttr(cmd *exec.Cmd) {
-	setupSysProcAttr(cmd)
+// SetupSysProcAttr prepares cmd to be started as a child of the current
+// process. If stdin is a terminal cmd shares the process group of the current
+// process, so the job control of the shell, such as ^Z and running in the
+// background, applies to both. Otherwise, or if init is set, cmd runs in its
+// own process group, so that signals can be forwarded to it and all of its
+// descendants, and as init the group is made the foreground group of the
+// terminal.
+func SetupSysProcAttr(cmd *exec.Cmd, init bool) {
+	setupSysProcAttr(cmd, init)
 }
 
+// ForwardSignal sends sig to the process group of cmd, or only to cmd if it
+// shares the process group of the current process.
 func ForwardSignal(cmd *exec.Cmd, sig os.Signal) {
 	forwardSignal(cmd, sig)
 }
+
+// TerminalSignal reports whether sig was sent by the terminal, such as SIGINT
+// for ^C, to the foreground process group which cmd shares with the current
+// process. cmd already received it then and it must not be forwarded.
+func TerminalSignal(cmd *exec.Cmd, sig os.Signal) bool {
+	return terminalSignal(cmd, sig)
+}
+
+// Signals returns the signals which are forwarded to the command.
+func Signals() []os.Signal {
+	return signals()
+}
+
+// ParseSignal returns the signal named name, such as "HUP" or "SIGHUP", or
+// given by its number.
+func ParseSignal(name string) (os.Signal, error) {
+	return parseSignal(name)
+}
+
+// RestoreForeground makes the process group of the current process the
+// foreground group of the terminal again after cmd exited, if SetupSysProcAttr
+// made cmd the foreground group, so that the next command can take it over.
+func RestoreForeground(cmd *exec.Cmd) {
+	restoreForeground(cmd)
+}
+
+// SetSubreaper makes the current process adopt its orphaned descendants, as
+// PID 1 does, so they can be reaped by WaitReaping. Only supported on linux.
+func SetSubreaper() error {
+	return setSubreaper()
+}
+
+// Wait waits for the started cmd to exit with cmd.Wait. If cmd is killed by a
+// signal an *ExitError is returned, like by WaitReaping.
+func Wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return &ExitError{Code: 128 + int(status.Signal())}
+		}
+	}
+	return err
+}
+
+// WaitReaping waits for the started cmd to exit, while reaping any other
+// child processes which exit in the meantime, such as orphans adopted as PID
+// 1. An *ExitError is returned if cmd does not exit with status 0. Unlike
+// cmd.Wait it does not wait for the copying of a Stdin, Stdout or Stderr which
+// is not an *os.File, so these must be copied by the caller.
+func WaitReaping(cmd *exec.Cmd) error {
+	return waitReaping(cmd)
+}
+
+// ExitError is the exit status of a command waited for by Wait or
+// WaitReaping. A command killed by a signal exits with 128 plus the signal
+// number, like in a shell.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// Exec replaces the current process with the program at path. It only
+// returns on error, and is not supported on windows.
+func Exec(path string, args []string, env []string) error {
+	return execProcess(path, args, env)
+}
@@ -4,17 +4,140 @@
 package proc
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
 )
 
-func setupSysProcAttr(cmd *exec.Cmd) {
+func setupSysProcAttr(cmd *exec.Cmd, init bool) {
+	terminal := cmd.Stdin == os.Stdin && term.IsTerminal(int(os.Stdin.Fd()))
+	if terminal && !init {
+		// stay in the job of the shell, a group of its own would not be
+		// stopped by ^Z along with ace and would take the terminal from the
+		// shell when run in the background
+		return
+	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
+	// as init there is no shell, keep the command in the foreground so it can
+	// read from the terminal and receives ^C directly
+	if terminal {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = int(os.Stdin.Fd())
+	}
+}
+
+func ownGroup(cmd *exec.Cmd) bool {
+	return cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid
 }
 
 func forwardSignal(cmd *exec.Cmd, sig os.Signal) {
-	syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+	if !ownGroup(cmd) {
+		cmd.Process.Signal(sig)
+		return
+	}
+	err := syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+	if errors.Is(err, syscall.ESRCH) {
+		// the process is not a group leader
+		cmd.Process.Signal(sig)
+	}
+}
+
+func terminalSignal(cmd *exec.Cmd, sig os.Signal) bool {
+	switch sig {
+	case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGWINCH:
+	default:
+		return false
+	}
+	if ownGroup(cmd) {
+		return false
+	}
+	// the terminal only signals its foreground group, when running in the
+	// background the signal was sent to the current process alone
+	pgrp, err := unix.IoctlGetInt(int(os.Stdin.Fd()), unix.TIOCGPGRP)
+	return err == nil && pgrp == syscall.Getpgrp()
+}
+
+func signals() []os.Signal {
+	return []os.Signal{
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGHUP,
+		syscall.SIGQUIT,
+		syscall.SIGUSR1,
+		syscall.SIGUSR2,
+		syscall.SIGWINCH,
+	}
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	sig := unix.SignalNum("SIG" + strings.TrimPrefix(strings.ToUpper(name), "SIG"))
+	if sig == 0 {
+		return nil, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+func restoreForeground(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil || !cmd.SysProcAttr.Foreground {
+		return
+	}
+	fd := int(os.Stdin.Fd())
+	// a background process group is stopped by SIGTTOU when it changes the
+	// foreground group
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, syscall.Getpgrp())
+}
+
+func waitReaping(cmd *exec.Cmd) error {
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	defer signal.Stop(sigchld)
+
+	for {
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if pid <= 0 {
+				// no more children have exited
+				break
+			}
+			if pid != cmd.Process.Pid {
+				continue
+			}
+
+			cmd.Process.Release()
+			switch {
+			case status.Exited() && status.ExitStatus() == 0:
+				return nil
+			case status.Exited():
+				return &ExitError{Code: status.ExitStatus()}
+			default:
+				return &ExitError{Code: 128 + int(status.Signal())}
+			}
+		}
+		<-sigchld
+	}
+}
+
+func execProcess(path string, args []string, env []string) error {
+	return syscall.Exec(path, args, env)
 }
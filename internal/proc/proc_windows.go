@@ -4,14 +4,53 @@
 package proc
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"strings"
+	"syscall"
 )
 
-func setupSysProcAttr(cmd *exec.Cmd) {
+func setupSysProcAttr(cmd *exec.Cmd, init bool) {
 	// Windows-specific setup if needed
 }
 
 func forwardSignal(cmd *exec.Cmd, sig os.Signal) {
 	cmd.Process.Signal(sig)
 }
+
+// there are no process groups which receive signals from the console
+func terminalSignal(cmd *exec.Cmd, sig os.Signal) bool {
+	return false
+}
+
+func signals() []os.Signal {
+	return []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "INT", "2":
+		return syscall.SIGINT, nil
+	case "KILL", "9":
+		return syscall.SIGKILL, nil
+	case "TERM", "15":
+		return syscall.SIGTERM, nil
+	case "HUP", "1":
+		return syscall.SIGHUP, nil
+	}
+	return nil, fmt.Errorf("unknown signal %q", name)
+}
+
+// there are no process groups to hand the console over to
+func restoreForeground(cmd *exec.Cmd) {}
+
+// there are no zombie processes on windows
+func waitReaping(cmd *exec.Cmd) error {
+	return cmd.Wait()
+}
+
+func execProcess(path string, args []string, env []string) error {
+	return errors.New("replacing the process is not supported on windows")
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package proc
+
+import "errors"
+
+func setSubreaper() error {
+	return errors.ErrUnsupported
+}
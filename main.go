@@ -1,133 +1,209 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/cipher"
-	"encoding/base32"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
 	"time"
-	"unicode"
 
 	"filippo.io/age"
 	arg "github.com/alexflint/go-arg"
-	"golang.org/x/crypto/chacha20poly1305"
+	"github.com/middle-management/ace/acefile"
 )
 
 type Main struct {
-	Env     *Env     `arg:"subcommand:env" help:"Expand to env and pass to command"`
-	Get     *Get     `arg:"subcommand:get" help:"Decrypt env with available identities"`
-	Set     *Set     `arg:"subcommand:set" help:"Append encrypted env vars to file"`
-	Version *Version `arg:"subcommand:version"`
+	Profile  string    `arg:"--profile,env:ACE_PROFILE" help:"Use the env files, recipients and identities of PROFILE from the project config"`
+	Env      *Env      `arg:"subcommand:env" help:"Expand to env and pass to command"`
+	Get      *Get      `arg:"subcommand:get" help:"Decrypt env with available identities"`
+	Set      *Set      `arg:"subcommand:set" help:"Append encrypted env vars to file"`
+	Verify   *Verify   `arg:"subcommand:verify" help:"Check that every block can be decrypted and required keys are set"`
+	Schema   *Schema   `arg:"subcommand:schema" help:"Check variables against the schema in the project config"`
+	Export   *Export   `arg:"subcommand:export" help:"Export variables to other tools, such as CI systems"`
+	Fsck     *Fsck     `arg:"subcommand:fsck" help:"Check env files for half-written blocks and repair them"`
+	Profiles *Profiles `arg:"subcommand:profiles" help:"List profiles defined in the project config"`
+	Config   *Config   `arg:"subcommand:config" help:"Inspect the project config"`
+	Version  *Version  `arg:"subcommand:version"`
 }
 
-const ACE_PREFIX = "# ace/v1:"
-
-func readEnvFile(src io.Reader, identities []age.Identity, keepQuotes bool) ([]string, error) {
-	var keys []string
-	vals := map[string]string{}
-
-	s := bufio.NewScanner(src)
-	var aead cipher.AEAD
-	for s.Scan() {
-		line := strings.TrimSpace(s.Text())
+// envVar is a decrypted variable and the file it was read from.
+type envVar struct {
+	acefile.Entry
+	File string
+}
 
-		// split on ACE_PREFIX
-		if strings.HasPrefix(line, ACE_PREFIX) {
-			// base32decode and armor decode age header
-			header, err := base32.StdEncoding.DecodeString(strings.TrimPrefix(line, ACE_PREFIX))
-			if err != nil {
-				return nil, err
-			}
+func environ(vars []envVar) []string {
+	var env []string
+	for _, v := range vars {
+		env = append(env, v.String())
+	}
+	return env
+}
 
-			var r io.Reader
-			r = bytes.NewReader(header)
+// openEnvFiles opens each of the env files in order. A path may be suffixed
+// with `:ignore`, `:warn` or `:error` to override onMissing for that file.
+// Missing files which are ignored or warned about are left out.
+func openEnvFiles(paths []string, onMissing string) ([]*os.File, error) {
+	if len(paths) == 0 {
+		paths = []string{"./.env.ace"}
+	}
 
-			// decrypt the block key using identities
-			r, err = age.Decrypt(r, identities...)
-			var noMatch *age.NoIdentityMatchError
-			if errors.As(err, &noMatch) {
-				// try next env block
-				aead = nil
-				continue
-			} else if err != nil {
-				return nil, err
-			}
-			blockKey, err := io.ReadAll(r)
-			if err != nil {
-				return nil, err
-			}
-			aead, err = chacha20poly1305.NewX(blockKey)
-			if err != nil {
-				return nil, err
+	var files []*os.File
+	for _, p := range paths {
+		path, fileOnMissing := splitOnMissing(p, onMissing)
+		f, err := os.Open(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				switch fileOnMissing {
+				case "ignore":
+					continue
+				case "warn", "warning":
+					slog.Warn("env-file not found", "env-file", path)
+					continue
+				}
 			}
+			closeEnvFiles(files)
+			return nil, err
 		}
+		files = append(files, f)
+	}
+	return files, nil
+}
 
-		if strings.HasPrefix(line, "#") {
-			continue
+// splitOnMissing splits an `:ignore`, `:warn` or `:error` suffix from path.
+// onMissing is returned if there is none.
+func splitOnMissing(path, onMissing string) (string, string) {
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		switch path[i+1:] {
+		case "ignore", "warn", "warning", "error":
+			return path[:i], path[i+1:]
 		}
+	}
+	return path, onMissing
+}
 
-		// decrypt each secret using block key
-		pair := strings.SplitN(line, "=", 2)
-		if len(pair) != 2 {
-			continue
-		}
+func closeEnvFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
 
-		if aead == nil {
-			continue
+// readEnvFiles reads each of the files in order. Values from later files
+// override values from earlier ones while keeping the order of first
+// appearance.
+func readEnvFiles(files []*os.File, identities []age.Identity, keepQuotes bool) ([]envVar, error) {
+	var vars []envVar
+	index := map[string]int{}
+	for _, f := range files {
+		fileVars, err := readEnvFile(f, identities, keepQuotes)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range fileVars {
+			v.File = f.Name()
+			if i, exists := index[v.Key]; exists {
+				vars[i] = v
+				continue
+			}
+			index[v.Key] = len(vars)
+			vars = append(vars, v)
 		}
+	}
+	return vars, nil
+}
 
-		secret, err := base32.StdEncoding.DecodeString(pair[1])
+// lookupEnvFiles resolves only keys, reading the files from the last one and
+// each file from its end. The vars are returned in the order of keys, keys
+// which are not set are left out.
+func lookupEnvFiles(files []*os.File, identities []age.Identity, keys []string, keepQuotes bool) ([]envVar, error) {
+	found := map[string]envVar{}
+	remaining := slices.Clone(keys)
+	for i := len(files) - 1; i >= 0 && len(remaining) > 0; i-- {
+		f := files[i]
+		stat, err := f.Stat()
 		if err != nil {
 			return nil, err
 		}
 
-		if len(secret) < aead.NonceSize() {
-			return nil, fmt.Errorf("ciphertext too short")
+		var entries []acefile.Entry
+		if stat.Mode().IsRegular() {
+			entries, err = acefile.Lookup(f, stat.Size(), remaining, identities...)
+		} else {
+			// pipes can only be read forward
+			entries, err = acefile.NewReader(f, identities...).ReadAll()
 		}
-		nonce, ciphertext := secret[:aead.NonceSize()], secret[aead.NonceSize():]
-
-		// Decrypt the message and check it wasn't tampered with.
-		plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
 		if err != nil {
 			return nil, err
 		}
 
-		if _, exists := vals[pair[0]]; !exists {
-			keys = append(keys, pair[0])
+		for _, e := range entries {
+			if !slices.Contains(remaining, e.Key) {
+				continue
+			}
+			if !keepQuotes {
+				e.Value, err = e.Unescaped()
+				if err != nil {
+					return nil, err
+				}
+			}
+			found[e.Key] = envVar{Entry: e, File: f.Name()}
 		}
-		vals[pair[0]] = string(plaintext)
+		remaining = slices.DeleteFunc(remaining, func(k string) bool {
+			_, ok := found[k]
+			return ok
+		})
 	}
 
-	var newVars []string
+	var vars []envVar
 	for _, k := range keys {
-		if keepQuotes {
-			newVars = append(newVars, k+"="+vals[k])
-		} else {
-			v, err := UnescapeValue(vals[k])
+		if v, ok := found[k]; ok {
+			vars = append(vars, v)
+			delete(found, k)
+		}
+	}
+	return vars, nil
+}
+
+func readEnvFile(src io.Reader, identities []age.Identity, keepQuotes bool) ([]envVar, error) {
+	entries, err := acefile.NewReader(src, identities...).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var newVars []envVar
+	for _, e := range entries {
+		if !keepQuotes {
+			e.Value, err = e.Unescaped()
 			if err != nil {
 				return nil, err
 			}
-			newVars = append(newVars, k+"="+v)
 		}
+		newVars = append(newVars, envVar{Entry: e})
 	}
 
 	return newVars, nil
 }
 
-func readIdentities(idents []string, onMissing string) ([]age.Identity, error) {
+// setConfigHome sets $XDG_CONFIG_HOME to the user config dir unless it is
+// set, so it can be used in the paths of identities.
+func setConfigHome() error {
 	if _, exists := os.LookupEnv("XDG_CONFIG_HOME"); !exists {
 		dir, err := os.UserConfigDir()
 		if err != nil {
-			return nil, fmt.Errorf("unable to read user config dir: %w", err)
+			return fmt.Errorf("unable to read user config dir: %w", err)
 		}
 		os.Setenv("XDG_CONFIG_HOME", dir)
 	}
+	return nil
+}
+
+func readIdentities(idents []string, onMissing string) ([]age.Identity, error) {
+	if err := setConfigHome(); err != nil {
+		return nil, err
+	}
 
 	if len(idents) == 0 {
 		idents = []string{"$XDG_CONFIG_HOME/ace/identity"}
@@ -168,89 +244,6 @@ func readIdentities(idents []string, onMissing string) ([]age.Identity, error) {
 	return identities, nil
 }
 
-func UnescapeValue(value string) (string, error) {
-	if len(value) == 0 {
-		return "", nil
-	}
-
-	trimmed := strings.TrimLeftFunc(value, unicode.IsSpace)
-	if len(trimmed) == 0 {
-		return value, nil
-	}
-	if trimmed[0] != '\'' && trimmed[0] != '"' {
-		return value, nil
-	}
-
-	var unescaped strings.Builder
-	var i int
-	state := "unquoted"
-
-	for i < len(value) {
-		c := value[i]
-
-		switch state {
-		case "unquoted":
-			if c == '\'' {
-				state = "singleQuoted"
-				i++
-			} else if c == '"' {
-				state = "doubleQuoted"
-				i++
-			} else if c == '\\' {
-				i++
-				if i >= len(value) {
-					return "", fmt.Errorf("unexpected end of string")
-				}
-				unescaped.WriteByte(value[i])
-				i++
-			} else {
-				unescaped.WriteByte(c)
-				i++
-			}
-		case "singleQuoted":
-			if c == '\'' {
-				state = "unquoted"
-				i++
-			} else {
-				unescaped.WriteByte(c)
-				i++
-			}
-		case "doubleQuoted":
-			if c == '"' {
-				state = "unquoted"
-				i++
-			} else if c == '\\' {
-				i++
-				if i >= len(value) {
-					return "", fmt.Errorf("unexpected end of string")
-				}
-				c2 := value[i]
-				switch c2 {
-				case '$', '`', '"', '\\', '\n':
-					unescaped.WriteByte(c2)
-				case 'n':
-					unescaped.WriteByte('\n')
-				case 't':
-					unescaped.WriteByte('\t')
-				default:
-					unescaped.WriteByte('\\')
-					unescaped.WriteByte(c2)
-				}
-				i++
-			} else {
-				unescaped.WriteByte(c)
-				i++
-			}
-		}
-	}
-
-	if state != "unquoted" {
-		return "", fmt.Errorf("unclosed quote in value")
-	}
-
-	return unescaped.String(), nil
-}
-
 // configurable for tests
 var input io.Reader = os.Stdin
 var output io.Writer = os.Stdout
@@ -272,13 +265,49 @@ func main() {
 	p := arg.MustParse(&args)
 
 	err := func() error {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		config, err := findConfig(wd)
+		if err != nil {
+			return err
+		}
+		profile, err := config.profile(args.Profile)
+		if err != nil {
+			return err
+		}
+
 		switch {
 		case args.Env != nil:
+			args.Env.profile = profile
 			return args.Env.Run()
 		case args.Get != nil:
+			args.Get.profile = profile
 			return args.Get.Run()
 		case args.Set != nil:
+			args.Set.profile = profile
 			return args.Set.Run()
+		case args.Verify != nil:
+			args.Verify.profile = profile
+			return args.Verify.Run()
+		case args.Schema != nil:
+			args.Schema.profile = profile
+			return args.Schema.Run()
+		case args.Export != nil:
+			args.Export.profile = profile
+			return args.Export.Run()
+		case args.Fsck != nil:
+			args.Fsck.profile = profile
+			return args.Fsck.Run()
+		case args.Profiles != nil:
+			args.Profiles.config = config
+			return args.Profiles.Run()
+		case args.Config != nil:
+			args.Config.config = config
+			args.Config.profileName = args.Profile
+			args.Config.profile = profile
+			return args.Config.Run()
 		case args.Version != nil:
 			args.Version.version = version
 			return args.Version.Run()
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Profiles struct {
+	config *configFile
+}
+
+func (cmd *Profiles) Run() error {
+	for _, name := range cmd.config.profileNames() {
+		p, err := cmd.config.profile(name)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(output, "%s\t%s\n", name, strings.Join(p.EnvFiles, ","))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// REDACT_MIN_LENGTH is the length below which values are not redacted, as
+// short values such as "1" or "on" would mask unrelated output.
+var REDACT_MIN_LENGTH = 4
+
+// REDACT_FLUSH_DELAY is how long output which could be the start of a value
+// is held back waiting for the rest of it.
+var REDACT_FLUSH_DELAY = 100 * time.Millisecond
+
+// redactPattern is a value, or an encoding of it, and what it is replaced by.
+type redactPattern struct {
+	value       []byte
+	replacement []byte
+}
+
+// redactor replaces the values of variables in output with ***KEY***. The
+// values can be updated while writers are in use.
+type redactor struct {
+	mu       sync.RWMutex
+	patterns []redactPattern
+	// first holds the indexes of the patterns by their first byte, longest
+	// first
+	first [256][]int
+}
+
+func newRedactor(vars []string) *redactor {
+	r := &redactor{}
+	r.setValues(vars)
+	return r
+}
+
+// setValues replaces the redacted values by those of vars, KEY=VALUE pairs.
+// Each value is also redacted in base64 and URL encoding, and each line of a
+// multiline value on its own.
+func (r *redactor) setValues(vars []string) {
+	var patterns []redactPattern
+	seen := map[string]bool{}
+	add := func(k, v string) {
+		if len(v) < REDACT_MIN_LENGTH || seen[v] {
+			return
+		}
+		seen[v] = true
+		patterns = append(patterns, redactPattern{value: []byte(v), replacement: []byte("***" + k + "***")})
+	}
+	for _, kv := range vars {
+		k, v, _ := strings.Cut(kv, "=")
+		values := []string{v}
+		if strings.Contains(v, "\n") {
+			values = append(values, strings.Split(v, "\n")...)
+		}
+		for _, v := range values {
+			add(k, v)
+			add(k, base64.RawStdEncoding.EncodeToString([]byte(v)))
+			add(k, base64.RawURLEncoding.EncodeToString([]byte(v)))
+			add(k, url.QueryEscape(v))
+			add(k, url.PathEscape(v))
+		}
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return len(patterns[i].value) > len(patterns[j].value)
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patterns = patterns
+	r.first = [256][]int{}
+	for i, p := range patterns {
+		r.first[p.value[0]] = append(r.first[p.value[0]], i)
+	}
+}
+
+// unionVars returns the KEY=VALUE pairs of vars followed by those of more
+// which are not in vars.
+func unionVars(vars, more []string) []string {
+	union := slices.Clone(vars)
+	for _, kv := range more {
+		if !slices.Contains(union, kv) {
+			union = append(union, kv)
+		}
+	}
+	return union
+}
+
+// redact returns buf with the values replaced and the number of bytes of buf
+// it covers. Unless final is set, the bytes at the end which could be the
+// start of a value are held back, so a value split across writes is still
+// redacted.
+func (r *redactor) redact(buf []byte, final bool) ([]byte, int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]byte, 0, len(buf))
+	i := 0
+scan:
+	for i < len(buf) {
+		for _, p := range r.first[buf[i]] {
+			value := r.patterns[p].value
+			if bytes.HasPrefix(buf[i:], value) {
+				out = append(out, r.patterns[p].replacement...)
+				i += len(value)
+				continue scan
+			}
+			if !final && len(buf)-i < len(value) && bytes.HasPrefix(value, buf[i:]) {
+				break scan
+			}
+		}
+		out = append(out, buf[i])
+		i++
+	}
+	return out, i
+}
+
+// redactWriter writes to w with the values of r redacted. What is held back
+// is written once no more output follows within REDACT_FLUSH_DELAY, such as
+// a prompt waiting for input, and by Close.
+type redactWriter struct {
+	r *redactor
+	w io.Writer
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	// writes counts the calls to Write, so a timer started before the last
+	// one does nothing
+	writes int
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.writes++
+	w.buf = append(w.buf, p...)
+	out, n := w.r.redact(w.buf, false)
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	if _, err := w.w.Write(out); err != nil {
+		return 0, err
+	}
+	if len(w.buf) > 0 {
+		writes := w.writes
+		w.timer = time.AfterFunc(REDACT_FLUSH_DELAY, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.writes == writes {
+				w.flush()
+			}
+		})
+	}
+	return len(p), nil
+}
+
+// flush writes what is held back, w.mu must be held.
+func (w *redactWriter) flush() error {
+	out, _ := w.r.redact(w.buf, true)
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(out)
+	return err
+}
+
+func (w *redactWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.writes++
+	return w.flush()
+}
+
+// pipe returns a pipe to use as the output of a command, which is copied to
+// w with the values redacted. A nil redactor copies the output as is. The
+// write end must be closed once the command started, and done is closed once
+// everything is copied.
+func (r *redactor) pipe(w io.Writer) (pw *os.File, done <-chan struct{}, err error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		defer pr.Close()
+		if r == nil {
+			io.Copy(w, pr)
+			return
+		}
+		rw := &redactWriter{r: r, w: w}
+		io.Copy(rw, pr)
+		rw.Close()
+	}()
+	return pw, copied, nil
+}
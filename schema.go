@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Schema struct {
+	Check *SchemaCheck `arg:"subcommand:check" help:"Report the variables which are missing or do not match the schema"`
+
+	profile Profile
+}
+
+type SchemaCheck struct {
+	EnvFiles   []string `arg:"--env-file,-e,separate" help:"Read variables from ENV-FILE. Can be repeated, later files override earlier ones. Defaults to ./.env.ace or the env files of the profile"`
+	Identities []string `arg:"--identity,-i,separate" help:"Decrypt using the specified IDENTITY. Can be repeated. Defaults to $XDG_CONFIG_HOME/ace/identity"`
+}
+
+// Run checks the variables against the schema, `check` is the default
+// subcommand.
+func (cmd *Schema) Run() error {
+	check := cmd.Check
+	if check == nil {
+		check = &SchemaCheck{}
+	}
+	if len(cmd.profile.Schema) == 0 {
+		slog.Warn("no schema in the project config")
+	}
+
+	onMissing := cmd.profile.OnMissing
+	if onMissing == "" {
+		onMissing = "error"
+	}
+	envFiles := check.EnvFiles
+	if len(envFiles) == 0 {
+		envFiles = cmd.profile.EnvFiles
+	}
+	files, err := openEnvFiles(envFiles, onMissing)
+	if err != nil {
+		return err
+	}
+	defer closeEnvFiles(files)
+
+	idents := check.Identities
+	if len(idents) == 0 {
+		idents = cmd.profile.Identities
+	}
+	identities, err := readIdentities(idents, onMissing)
+	if err != nil {
+		return err
+	}
+
+	vars, err := readEnvFiles(files, identities, false)
+	if err != nil {
+		return err
+	}
+
+	violations := checkSchema(cmd.profile.Schema, environ(vars))
+	for _, v := range violations {
+		fmt.Fprintln(output, v)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%d schema violations", len(violations))
+	}
+	return nil
+}
+
+// VarSchema declares an expected variable in the `schema` section of the
+// project config, such as:
+//
+//	[schema.DATABASE_URL]
+//	type = "url"
+//	required = true
+//	description = "Connection string of the primary database"
+type VarSchema struct {
+	// Type is one of string, int, bool, url, duration or json. Defaults to
+	// string.
+	Type string `toml:"type,omitempty" yaml:"type,omitempty"`
+	// Pattern is a regular expression the whole value must match.
+	Pattern     string `toml:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Required    bool   `toml:"required,omitempty" yaml:"required,omitempty"`
+	Description string `toml:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// validate checks that value is of the type and matches the pattern.
+func (s VarSchema) validate(value string) error {
+	var err error
+	switch s.Type {
+	case "", "string":
+	case "int":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "url":
+		var u *url.URL
+		u, err = url.Parse(value)
+		if err == nil && (u.Scheme == "" || u.Host == "") {
+			err = fmt.Errorf("missing scheme or host")
+		}
+	case "duration":
+		_, err = time.ParseDuration(value)
+	case "json":
+		if !json.Valid([]byte(value)) {
+			err = fmt.Errorf("invalid JSON")
+		}
+	default:
+		return fmt.Errorf("unknown type %q in schema", s.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("not a valid %s: %w", s.Type, unwrapNumError(err))
+	}
+
+	if s.Pattern != "" {
+		re, err := regexp.Compile("^(?:" + s.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid pattern in schema: %w", err)
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("does not match pattern %q", s.Pattern)
+		}
+	}
+	return nil
+}
+
+// unwrapNumError drops the repetition of the value from strconv errors.
+func unwrapNumError(err error) error {
+	if numErr, ok := err.(*strconv.NumError); ok {
+		return numErr.Err
+	}
+	return err
+}
+
+// checkSchema returns the violations of the schema by vars, which are
+// KEY=VALUE pairs with unescaped values. Variables which are not declared in
+// the schema are allowed.
+func checkSchema(schema map[string]VarSchema, vars []string) []string {
+	vals := map[string]string{}
+	for _, kv := range vars {
+		k, v, _ := strings.Cut(kv, "=")
+		vals[k] = v
+	}
+
+	var keys []string
+	for k := range schema {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var violations []string
+	for _, k := range keys {
+		v, ok := vals[k]
+		if !ok {
+			if schema[k].Required {
+				violations = append(violations, fmt.Sprintf("%s: required key is not set", k))
+			}
+			continue
+		}
+		if err := schema[k].validate(v); err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %v", k, err))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// secretsDir holds a file for the value of each variable, named after its
+// key. The directory is created by the first write, in dir or, if dir is
+// empty, as a new directory in $XDG_RUNTIME_DIR, which usually is a tmpfs, or
+// the temp dir. remove deletes the directory and must be called once the
+// files are no longer needed.
+type secretsDir struct {
+	dir  string
+	path string
+}
+
+// write replaces the files in the directory by the values of vars and returns
+// KEY_FILE variables pointing to them. Files of keys which are no longer set
+// are removed.
+func (d *secretsDir) write(vars []string) (fileVars []string, err error) {
+	if d.path == "" {
+		if err := d.create(); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	for _, kv := range vars {
+		k, v, _ := strings.Cut(kv, "=")
+		path := filepath.Join(d.path, k)
+		if filepath.Dir(path) != d.path {
+			continue
+		}
+		if err := writeSecretFile(path, v); err != nil {
+			return nil, err
+		}
+		names = append(names, k)
+		fileVars = append(fileVars, k+"_FILE="+path)
+	}
+
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !slices.Contains(names, e.Name()) {
+			if err := os.Remove(filepath.Join(d.path, e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fileVars, nil
+}
+
+func (d *secretsDir) create() error {
+	var err error
+	dir := d.dir
+	if dir == "" {
+		base := os.Getenv("XDG_RUNTIME_DIR")
+		if base == "" {
+			base = os.TempDir()
+		}
+		dir, err = os.MkdirTemp(base, "ace-secrets-")
+	} else {
+		// never remove a directory that already existed
+		err = os.Mkdir(dir, 0o700)
+	}
+	if err != nil {
+		return err
+	}
+	d.path, err = filepath.Abs(dir)
+	if err != nil {
+		os.Remove(dir)
+	}
+	return err
+}
+
+func (d *secretsDir) remove() error {
+	if d.path == "" {
+		return nil
+	}
+	return os.RemoveAll(d.path)
+}
+
+// writeSecretFile replaces the file at path by a read-only one containing
+// value, so a command reading it never sees a partially written value.
+func writeSecretFile(path, value string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(value)
+	if err == nil {
+		err = f.Chmod(0o400)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -2,26 +2,40 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strings"
 
 	"filippo.io/age"
-	"golang.org/x/crypto/chacha20poly1305"
+	"github.com/middle-management/ace/acefile"
+	"github.com/middle-management/ace/internal/lock"
 )
 
 type Set struct {
-	RecipientFiles []string `arg:"--recipient-file,-R,separate" help:"Encrypt to recipients listed at RECIPIENT-FILE. Can be repeated. Defaults to ./recipients.txt"`
-	Recipients     []string `arg:"--recipient,-r,separate" help:"Encrypt to the specified RECIPIENT. Can be repeated."`
-	EnvFile        string   `arg:"--env-file,-e" default:"./.env.ace"`
-	EnvPairs       []string `arg:"positional"`
+	RecipientFiles   []string `arg:"--recipient-file,-R,separate" help:"Encrypt to recipients listed at RECIPIENT-FILE. Can be repeated. Defaults to ./recipients.txt or the recipient files of the profile"`
+	Recipients       []string `arg:"--recipient,-r,separate" help:"Encrypt to the specified RECIPIENT. Can be repeated."`
+	EnvFile          string   `arg:"--env-file,-e" help:"Append to ENV-FILE. Defaults to ./.env.ace or the last env file of the profile"`
+	AllowInvalidKeys bool     `arg:"--allow-invalid-keys" help:"Accept keys which are not valid POSIX environment variable names"`
+	Format           string   `arg:"--format" help:"Format version to write, 'v2' is more compact but can not be read by older versions of ace. Defaults to 'v2' if the env file has v2 blocks and 'v1' otherwise"`
+	EnvPairs         []string `arg:"positional"`
+
+	profile Profile
 }
 
 func (cmd *Set) Run() error {
+	pairs, err := cmd.readPairs()
+	if err != nil {
+		return err
+	}
+
 	recs := cmd.Recipients
 	files := cmd.RecipientFiles
+	if len(files) == 0 {
+		files = cmd.profile.RecipientFiles
+	}
 	if len(files) == 0 {
 		files = []string{"./recipients.txt"}
 	}
@@ -48,63 +62,129 @@ func (cmd *Set) Run() error {
 		recipients = append(recipients, rec...)
 	}
 
-	blockKey := make([]byte, chacha20poly1305.KeySize)
-	if _, err := rand.Read(blockKey); err != nil {
-		return err
+	envFile := cmd.EnvFile
+	if envFile == "" && len(cmd.profile.EnvFiles) > 0 {
+		envFile, _ = splitOnMissing(cmd.profile.EnvFiles[len(cmd.profile.EnvFiles)-1], "")
+	}
+	if envFile == "" {
+		envFile = "./.env.ace"
 	}
 
 	buf := bytes.NewBuffer(nil)
-
-	// encrypt the key using age
-	err := func() error {
-		w, err := age.Encrypt(buf, recipients...)
+	w := acefile.NewWriter(buf, recipients...)
+	switch cmd.Format {
+	case "":
+		// keep the file readable by older versions of ace until it is
+		// migrated
+		w.Format, err = envFileFormat(envFile)
 		if err != nil {
 			return err
 		}
-		defer w.Close()
-
-		_, err = w.Write(blockKey)
+	case "v2":
+		w.Format = acefile.V2
+	case "v1":
+		w.Format = acefile.V1
+	default:
+		return fmt.Errorf("invalid --format %q, must be 'v1' or 'v2'", cmd.Format)
+	}
+	for _, pair := range pairs {
+		data, binary, err := readBinaryValue(pair[1])
+		if err != nil {
+			return fmt.Errorf("%s: %w", pair[0], err)
+		}
+		if schema, ok := cmd.profile.Schema[pair[0]]; ok {
+			v := string(data)
+			if !binary {
+				v, err = acefile.UnescapeValue(pair[1])
+				if err != nil {
+					return err
+				}
+			}
+			if err := schema.validate(v); err != nil {
+				return fmt.Errorf("%s: %w", pair[0], err)
+			}
+		}
+		if binary {
+			err = w.SetBinary(pair[0], data)
+		} else {
+			err = w.Set(pair[0], pair[1])
+		}
 		if err != nil {
 			return err
 		}
-		return nil
-	}()
-	if err != nil {
+	}
+	if err := w.Flush(); err != nil {
 		return err
 	}
 
-	dst, err := os.OpenFile(cmd.EnvFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	dst, err := os.OpenFile(envFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
 		return err
 	}
 	defer dst.Close()
 
-	_, err = io.WriteString(dst, ACE_PREFIX+base32.StdEncoding.EncodeToString(buf.Bytes())+"\n")
-	if err != nil {
-		return err
+	// the block is written in a single append while holding the lock, so
+	// concurrent runs never interleave their lines
+	if err := lock.Lock(dst); err != nil {
+		return fmt.Errorf("unable to lock %s: %w", envFile, err)
 	}
+	defer lock.Unlock(dst)
 
-	aead, err := chacha20poly1305.NewX(blockKey)
-	if err != nil {
-		return err
+	_, err = dst.Write(buf.Bytes())
+	return err
+}
+
+// envFileFormat returns the highest format version of the blocks in the env
+// file at path, or v1 if it does not exist yet.
+func envFileFormat(path string) (acefile.Format, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return acefile.V1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return acefile.HighestFormat(f)
+}
+
+// readPairs returns the KEY=VALUE pairs from the arguments or, if there are
+// none, from input. Keys are validated and may only be set once.
+func (cmd *Set) readPairs() ([][2]string, error) {
+	var pairs [][2]string
+	var sources []string
+	add := func(line, source string) {
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 {
+			return
+		}
+		pairs = append(pairs, [2]string{pair[0], pair[1]})
+		sources = append(sources, source)
 	}
 
-	pairs := cmd.EnvPairs
-	if len(pairs) == 0 {
+	if len(cmd.EnvPairs) > 0 {
+		for i, p := range cmd.EnvPairs {
+			add(p, fmt.Sprintf("argument %d", i+1))
+		}
+	} else {
 		data, _ := io.ReadAll(input)
 		var cur strings.Builder
 		var inQuote byte
 		var escaped bool
+		lineNo, startLine := 1, 1
 		for _, c := range data {
 			if inQuote == 0 && c == '\n' {
 				line := cur.String()
 				cur.Reset()
 				trimmed := strings.TrimSpace(line)
-				if trimmed == "" || trimmed[0] == '#' || !strings.Contains(line, "=") {
-					continue
+				if trimmed != "" && trimmed[0] != '#' {
+					add(line, fmt.Sprintf("line %d", startLine))
 				}
-				pairs = append(pairs, line)
+				lineNo++
+				startLine = lineNo
 			} else {
+				if c == '\n' {
+					lineNo++
+				}
 				cur.WriteByte(c)
 				if escaped {
 					escaped = false
@@ -117,37 +197,54 @@ func (cmd *Set) Run() error {
 				}
 			}
 		}
-		if line := cur.String(); strings.TrimSpace(line) != "" && strings.Contains(line, "=") {
-			pairs = append(pairs, line)
+		if line := cur.String(); strings.TrimSpace(line) != "" {
+			add(line, fmt.Sprintf("line %d", startLine))
 		}
 	}
 
-	for _, p := range pairs {
-		pair := strings.SplitN(p, "=", 2)
-		if len(pair) != 2 {
-			continue
-		}
-
-		_, err := UnescapeValue(pair[1])
-		if err != nil {
-			return err
+	seen := map[string]string{}
+	for i, pair := range pairs {
+		if err := validateKey(pair[0], cmd.AllowInvalidKeys); err != nil {
+			return nil, fmt.Errorf("%s: %w", sources[i], err)
 		}
-
-		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(pair[1])+aead.Overhead())
-		if _, err := rand.Read(nonce); err != nil {
-			return err
-		}
-
-		secret := base32.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(pair[1]), nil))
-		_, err = io.WriteString(dst, pair[0]+"="+secret+"\n")
-		if err != nil {
-			return err
+		if first, exists := seen[pair[0]]; exists {
+			return nil, fmt.Errorf("%s: duplicate key %q (first set on %s)", sources[i], pair[0], first)
 		}
+		seen[pair[0]] = sources[i]
 	}
-	_, err = io.WriteString(dst, "\n")
-	if err != nil {
+	return pairs, nil
+}
+
+// validateKey checks that key is a valid POSIX environment variable name. When
+// allowInvalid is set only keys that would corrupt the env file are rejected.
+func validateKey(key string, allowInvalid bool) error {
+	if err := acefile.CheckKey(key); err != nil || allowInvalid {
 		return err
 	}
 
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c != '_' && !isAlpha(c) && (i == 0 || !isDigit(c)) {
+			return fmt.Errorf("invalid key %q: must start with a letter or underscore followed by letters, digits or underscores", key)
+		}
+	}
 	return nil
 }
+
+// BASE64_PREFIX marks a base64 encoded binary value, this is how `ace get`
+// prints binary values so they can be piped back to `ace set`.
+const BASE64_PREFIX = "@base64:"
+
+// readBinaryValue returns the contents of the file for `@path` values and the
+// decoded bytes of `@base64:...` values. Quote a value to store a literal @.
+func readBinaryValue(value string) ([]byte, bool, error) {
+	if !strings.HasPrefix(value, "@") {
+		return nil, false, nil
+	}
+	if b64, ok := strings.CutPrefix(value, BASE64_PREFIX); ok {
+		data, err := base64.StdEncoding.DecodeString(b64)
+		return data, true, err
+	}
+	data, err := os.ReadFile(value[1:])
+	return data, true, err
+}
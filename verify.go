@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/middle-management/ace/acefile"
+)
+
+type Verify struct {
+	EnvFiles    []string `arg:"--env-file,-e,separate" help:"Verify ENV-FILE. Can be repeated, later files override earlier ones. Defaults to ./.env.ace or the env files of the profile"`
+	Identities  []string `arg:"--identity,-i,separate" help:"Verify using the specified IDENTITY, such as the one used in CI. Can be repeated. Defaults to $XDG_CONFIG_HOME/ace/identity"`
+	Require     []string `arg:"--require,separate" help:"Require each of the comma separated KEYS to be set. Can be repeated"`
+	RequireFile string   `arg:"--require-file" help:"Require each of the keys listed in REQUIRE-FILE, one per line"`
+
+	profile Profile
+}
+
+// keySource is where the newest value of a key was set.
+type keySource struct {
+	file      string
+	order     int
+	block     int
+	line      int
+	decrypted bool
+}
+
+// newer reports whether s was set after than. Every source is newer than the
+// zero value.
+func (s keySource) newer(than keySource) bool {
+	return s.order > than.order || (s.order == than.order && s.block > than.block)
+}
+
+// Run checks that every block of the env files can be decrypted by the
+// identities and that the required keys resolve to their newest value. Each
+// problem is printed as FILE:LINE: MESSAGE and Run fails if there are any.
+func (cmd *Verify) Run() error {
+	required, err := cmd.requiredKeys()
+	if err != nil {
+		return err
+	}
+
+	onMissing := cmd.profile.OnMissing
+	if onMissing == "" {
+		onMissing = "error"
+	}
+	envFiles := cmd.EnvFiles
+	if len(envFiles) == 0 {
+		envFiles = cmd.profile.EnvFiles
+	}
+	files, err := openEnvFiles(envFiles, onMissing)
+	if err != nil {
+		return err
+	}
+	defer closeEnvFiles(files)
+
+	idents := cmd.Identities
+	if len(idents) == 0 {
+		idents = cmd.profile.Identities
+	}
+	identities, err := readIdentities(idents, "error")
+	if err != nil {
+		return err
+	}
+	if len(identities) == 0 {
+		return fmt.Errorf("no identities specified")
+	}
+
+	var problems int
+	report := func(format string, args ...any) {
+		problems++
+		fmt.Fprintf(output, format+"\n", args...)
+	}
+
+	newest := map[string]keySource{}
+	resolved := map[string]keySource{}
+	for i, f := range files {
+		r := acefile.NewReader(f, identities...)
+		entries, err := r.ReadAll()
+		if err != nil {
+			report("%s: %v", f.Name(), err)
+			continue
+		}
+
+		for _, e := range entries {
+			s := keySource{file: f.Name(), order: i, block: e.Block, line: e.Line, decrypted: true}
+			resolved[e.Key] = s
+			if s.newer(newest[e.Key]) {
+				newest[e.Key] = s
+			}
+		}
+		for _, b := range r.Skipped {
+			report("%s:%d: block %d can not be decrypted, it sets %s", f.Name(), b.Line, b.Block, strings.Join(b.Keys, ", "))
+			for _, k := range b.Keys {
+				s := keySource{file: f.Name(), order: i, block: b.Block, line: b.Line}
+				if s.newer(newest[k]) {
+					newest[k] = s
+				}
+			}
+		}
+	}
+
+	for _, k := range required {
+		n, ok := newest[k]
+		switch {
+		case !ok:
+			report("%s: required key is not set", k)
+		case !n.decrypted:
+			if r, ok := resolved[k]; ok {
+				report("%s:%d: %s: the newest value can not be decrypted, the older value from %s:%d is used", n.file, n.line, k, r.file, r.line)
+			} else {
+				report("%s:%d: %s: required key can not be decrypted", n.file, n.line, k)
+			}
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("verification failed with %d problems", problems)
+	}
+	fmt.Fprintf(output, "ok: all blocks in %d files can be decrypted and %d required keys are set\n", len(files), len(required))
+	return nil
+}
+
+// requiredKeys returns the keys of --require and --require-file. Blank lines
+// and lines starting with # are ignored in the file.
+func (cmd *Verify) requiredKeys() ([]string, error) {
+	var keys []string
+	for _, r := range cmd.Require {
+		for _, k := range strings.Split(r, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				keys = appendUnique(keys, k)
+			}
+		}
+	}
+	if cmd.RequireFile == "" {
+		return keys, nil
+	}
+
+	f, err := os.Open(cmd.RequireFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		k := strings.TrimSpace(s.Text())
+		if k != "" && !strings.HasPrefix(k, "#") {
+			keys = appendUnique(keys, k)
+		}
+	}
+	return keys, s.Err()
+}
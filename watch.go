@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// WATCH_INTERVAL is how often the files are checked for changes with --watch.
+var WATCH_INTERVAL = time.Second
+
+// fileStamp changes whenever a file is written.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// statFiles returns the stamp of each of paths. Missing files have the zero
+// stamp, so they are noticed once they are created.
+func statFiles(paths []string) map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, p := range paths {
+		var s fileStamp
+		if fi, err := os.Stat(p); err == nil {
+			s = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+		stamps[p] = s
+	}
+	return stamps
+}